@@ -0,0 +1,288 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+	"time"
+)
+
+// The files in a certificates directory. Each client gets a directory of its
+// own in there, named after it, with its files and the CA named as
+// DOCKER_CERT_PATH expects them.
+const (
+	caCertFile     = "ca.pem"
+	caKeyFile      = "ca-key.pem"
+	serverCertFile = "server-cert.pem"
+	serverKeyFile  = "server-key.pem"
+	clientCertFile = "cert.pem"
+	clientKeyFile  = "key.pem"
+)
+
+// Where the certificates go, unless told otherwise.
+func defaultCertsDir() string {
+	usr, err := user.Current()
+	if err != nil {
+		return "certs"
+	}
+	return path.Join(usr.HomeDir, ".docker-cloud/certs")
+}
+
+// Builds the TLS configuration of the proxy listener from the server key
+// pair, requiring clients to present a certificate signed by the CA in
+// caFile if verify is true.
+func serverTLSConfig(caFile, certFile, keyFile string, verify bool) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if verify {
+		data, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificate in %s", caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// Generates the certificates of the proxy in dir: a CA, unless there is one
+// already, a server certificate valid for hosts, unless there is one signed by
+// the CA and valid for hosts already, and a client certificate for cn, in a directory named after
+// it, all valid for validity. Refuses to replace the certificate of a client.
+func generateCerts(dir string, hosts []string, cn string, validity time.Duration) error {
+	if cn == "" || cn == "." || cn == ".." || strings.ContainsAny(cn, `/\`) {
+		return fmt.Errorf("invalid client name %q", cn)
+	}
+	clientDir := path.Join(dir, cn)
+	if _, err := os.Stat(path.Join(clientDir, clientCertFile)); err == nil {
+		return fmt.Errorf("there is a certificate for %q in %s already", cn, clientDir)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	caCert, caKey, err := loadCA(dir)
+	if err != nil {
+		return err
+	}
+	if caCert == nil {
+		log.Printf("Generating a CA in %s", dir)
+		caCert, caKey, err = generateCert(dir, caCertFile, caKeyFile, &x509.Certificate{
+			Subject:               pkix.Name{CommonName: "docker-cloud CA"},
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}, validity, nil, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	serverCert, _, err := loadKeyPair(path.Join(dir, serverCertFile), path.Join(dir, serverKeyFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Clients wouldn't trust a server certificate from another CA, or for
+	// other hosts.
+	if serverCert == nil || serverCert.CheckSignatureFrom(caCert) != nil || !coversHosts(serverCert, hosts) {
+		log.Printf("Generating a server certificate for %s", strings.Join(hosts, ", "))
+		template := &x509.Certificate{
+			Subject:     pkix.Name{CommonName: hosts[0]},
+			KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}
+		for _, host := range hosts {
+			if ip := net.ParseIP(host); ip != nil {
+				template.IPAddresses = append(template.IPAddresses, ip)
+			} else {
+				template.DNSNames = append(template.DNSNames, host)
+			}
+		}
+		if _, _, err := generateCert(dir, serverCertFile, serverKeyFile, template, validity, caCert, caKey); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("Generating a client certificate for %q in %s", cn, clientDir)
+	if err := os.MkdirAll(clientDir, 0700); err != nil {
+		return err
+	}
+	caData, err := ioutil.ReadFile(path.Join(dir, caCertFile))
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path.Join(clientDir, caCertFile), caData, 0644); err != nil {
+		return err
+	}
+	_, _, err = generateCert(clientDir, clientCertFile, clientKeyFile, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, validity, caCert, caKey)
+	return err
+}
+
+// Whether cert is valid for each of hosts.
+func coversHosts(cert *x509.Certificate, hosts []string) bool {
+	for _, host := range hosts {
+		if cert.VerifyHostname(host) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Loads the CA in dir, or returns nil if there is none. Refuses to go on with
+// half a CA, rather than make a new one that the certificates handed out
+// already wouldn't be signed by.
+func loadCA(dir string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certFile, keyFile := path.Join(dir, caCertFile), path.Join(dir, caKeyFile)
+	_, certErr := os.Stat(certFile)
+	_, keyErr := os.Stat(keyFile)
+	if os.IsNotExist(certErr) && os.IsNotExist(keyErr) {
+		return nil, nil, nil
+	}
+	if os.IsNotExist(certErr) || os.IsNotExist(keyErr) {
+		return nil, nil, fmt.Errorf("only one of %s and %s is there, restore the other or remove both to make a new CA", certFile, keyFile)
+	}
+	return loadKeyPair(certFile, keyFile)
+}
+
+// Generates a key and a certificate from template, signed by parent, or
+// self-signed if parent is nil, and writes them to certFile and keyFile in
+// dir.
+func generateCert(dir, certFile, keyFile string, template *x509.Certificate, validity time.Duration, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(validity)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyData := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	if err := ioutil.WriteFile(path.Join(dir, keyFile), keyData, 0600); err != nil {
+		return nil, nil, err
+	}
+	certData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(path.Join(dir, certFile), certData, 0644); err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// Loads the certificate and key generated by generateCert.
+func loadKeyPair(certFile, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	certData, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyData, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	certBlock, _ := pem.Decode(certData)
+	keyBlock, _ := pem.Decode(keyData)
+	if certBlock == nil || keyBlock == nil {
+		return nil, nil, errors.New("bad PEM data in " + certFile + " or " + keyFile)
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// Generates the certificates securing the proxy listener.
+type certsCmd struct {
+	dir      *string
+	hosts    *string
+	cn       *string
+	validity *time.Duration
+}
+
+// Defines the flags required by certs subcommand.
+func (cmd *certsCmd) Flags(fs *flag.FlagSet) *flag.FlagSet {
+	cmd.dir = fs.String("dir", defaultCertsDir(), "Where to write the certificates")
+	cmd.hosts = fs.String("hosts", "localhost,127.0.0.1", "The comma separated host names and addresses the proxy is reached at")
+	cmd.cn = fs.String("cn", "client", "The name of the client, which -routeby=cert tells clients apart by, and the directory its certificate goes to")
+	cmd.validity = fs.Duration("validity", 365*24*time.Hour, "How long the certificates are valid for")
+	return fs
+}
+
+// Handles the certs command.
+func (cmd *certsCmd) Run(args []string) {
+	var hosts []string
+	for _, host := range strings.Split(*cmd.hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		log.Fatal("No hosts to make the server certificate for")
+	}
+	if err := generateCerts(*cmd.dir, hosts, *cmd.cn, *cmd.validity); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Done, start the proxy with -tlsverify, and run docker with --tlsverify and DOCKER_CERT_PATH=%s", path.Join(*cmd.dir, *cmd.cn))
+}
@@ -0,0 +1,86 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// A subcommand of the program, such as start.
+type subcommand interface {
+	// Defines the flags of the subcommand on fs, and returns it.
+	Flags(fs *flag.FlagSet) *flag.FlagSet
+	// Runs the subcommand with the arguments left after its flags.
+	Run(args []string)
+}
+
+type registeredCommand struct {
+	name          string
+	description   string
+	cmd           subcommand
+	requiredFlags []string
+}
+
+var commands []registeredCommand
+
+// Registers cmd to handle `program [args...] name [subcommand-args...]`,
+// failing unless the flags in requiredFlags are set.
+func onCommand(name, description string, cmd subcommand, requiredFlags []string) {
+	commands = append(commands, registeredCommand{name, description, cmd, requiredFlags})
+}
+
+// Parses the command line, and runs the subcommand it names.
+func parseAndRun() {
+	flag.Usage = usage
+	flag.Parse()
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name != args[0] {
+			continue
+		}
+		fs := c.cmd.Flags(flag.NewFlagSet(c.name, flag.ExitOnError))
+		fs.Parse(args[1:])
+		set := make(map[string]bool)
+		fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+		for _, name := range c.requiredFlags {
+			if !set[name] {
+				fmt.Fprintf(os.Stderr, "missing required flag -%s\n", name)
+				fs.Usage()
+				os.Exit(2)
+			}
+		}
+		c.cmd.Run(fs.Args())
+		return
+	}
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	var names []string
+	for _, c := range commands {
+		names = append(names, fmt.Sprintf("  %-8s %s", c.name, c.description))
+	}
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n%s\n\nRun %s <command> -h for the flags of a command.\n",
+		os.Args[0], strings.Join(names, "\n"), os.Args[0])
+}
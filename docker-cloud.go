@@ -15,131 +15,377 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
-	"net/url"
+	"os"
+	"os/signal"
+	"path"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/googlecloudplatform/docker-cloud/dockercloud"
-	"github.com/rakyll/command"
 )
 
-// Try to connect to a tunnel to the docker dameon if it exists.
-// url is the URL to test.
-// returns true, if the connection was successful, false otherwise
-type Tunnel struct {
-	url.URL
-}
-
-func (t Tunnel) isActive() bool {
-	_, err := http.Get(t.String())
-	return err == nil
-}
-
 type ProxyServer struct {
-	// TODO(jbd): instance name and zone belongs to GCECloud.
 	instanceName string
-	zone         string
+	dockerPort   int
+
+	// How long to wait for a new instance before giving up, 0 waits for as
+	// long as the client does.
+	createTimeout time.Duration
+
+	// How long the instance may sit idle before it is torn down, 0 keeps it
+	// forever, and how it is torn down, one of the idle policies.
+	idleTimeout time.Duration
+	idlePolicy  string
 
-	tunnelPort int
-	dockerPort int
+	provider dockercloud.Provider
+	// Instances kept ready ahead of time, nil when there is no pool.
+	pool *instancePool
+	// The ports forwarded to localhost, nil when ports aren't forwarded.
+	forwards *portForwards
+	// Whether to open published ports to the outside world on the instance.
+	exposePorts bool
+	// What clients may ask the daemon for, nil lets them ask for anything.
+	policy *policy
 
-	cloud dockercloud.Cloud
+	// Guards the fields below, which are shared by all requests.
+	mu sync.Mutex
+	// The instance, created on demand.
+	slot *instanceSlot
+	// The tunnel to the instance it was opened to, and a transport through it.
+	tunnel         dockercloud.Tunnel
+	tunnelInstance dockercloud.Instance
+	transport      *http.Transport
+	// The API version the proxy speaks to the daemon through the tunnel.
+	apiVersion string
+	// Requests in flight, and when the last one ended.
+	active     int
+	lastActive time.Time
 }
 
-func (server ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+// The host the docker daemon is addressed as. Connections are made through
+// the tunnel whatever the host, so it is only there to make URLs.
+const dockerHost = "docker"
+
+func (server *ProxyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if server.policy != nil {
+		if err := server.policy.check(r); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+	}
+	server.beginRequest()
+	defer server.endRequest()
 	err := server.doServe(w, r)
 	if err != nil {
-		fmt.Printf("Error: %s\n", err)
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "{'error': '%s'}", err)
+		writeError(w, 500, err)
 	}
 }
 
-func (server ProxyServer) doServe(w http.ResponseWriter, r *http.Request) error {
-	var err error
-	var ip string
+// Reports err to the client with status.
+func writeError(w http.ResponseWriter, status int, err error) {
+	log.Printf("Error: %v", err)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	// The way the daemon reports errors, so that clients show the message.
+	json.NewEncoder(w).Encode(struct {
+		Message string `json:"message"`
+	}{err.Error()})
+}
+
+func (server *ProxyServer) doServe(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
 	path := r.URL.Path
-	query := r.URL.RawQuery
-	host := fmt.Sprintf("localhost:%d", server.tunnelPort)
-	targetUrl := fmt.Sprintf("http://%s%s?%s", host, path, query)
-
-	w.Header().Add("Content-Type", "application/json")
-
-	// Try to find a VM instance.
-	ip, err = server.cloud.GetPublicIPAddress(server.instanceName, server.zone)
-	instanceRunning := len(ip) > 0
-	// err is 404 if the instance doesn't exist, so we only error out when
-	// instanceRunning is true.
-	if err != nil && instanceRunning {
+	// The path as the client escaped it, so that names holding a / or a ?
+	// reach the daemon the way they were sent.
+	targetUrl := fmt.Sprintf("http://%s%s", dockerHost, r.URL.EscapedPath())
+	if r.URL.RawQuery != "" {
+		targetUrl += "?" + r.URL.RawQuery
+	}
+
+	// Find the VM instance, creating it unless the request is 'ps' or a
+	// ping, which clients send before anything else.
+	ps := r.Method == "GET" && strings.HasSuffix(path, "/containers/json")
+	ping := (r.Method == "GET" || r.Method == "HEAD") && apiPath.FindStringSubmatch(path)[2] == "/_ping"
+	slot := server.instanceSlot()
+	instance, err := slot.get(ctx, !ps && !ping)
+	if err != nil {
 		return err
 	}
 
-	// If there's no VM instance, and the request is 'ps' just return []
-	if r.Method == "GET" && strings.HasSuffix(path, "/containers/json") && !instanceRunning {
+	// If there's no VM instance, answer the ping locally, and if the request
+	// is 'ps' just return []
+	if instance == nil && ping {
+		writePing(w, r)
+		return nil
+	}
+	if instance == nil {
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(200)
 		fmt.Fprintf(w, "[]")
 		return nil
 	}
 
-	// Otherwise create a new VM.
-	if !instanceRunning {
-		ip, err = server.cloud.CreateInstance(server.instanceName, server.zone)
-		if err != nil {
-			return err
-		}
-	}
-
 	// Test for the SSH tunnel, create if it doesn't exist.
-	tunnelUrl, err := url.Parse("http://" + host + "/v1.6/containers/json")
+	api, err := server.openTunnel(ctx, instance)
 	if err != nil {
+		// Maybe the instance went away behind our back.
+		slot.invalidate(instance)
 		return err
 	}
-	tunnel := Tunnel{*tunnelUrl}
+	// Requests go through in the API version the client asked for.
+	transport := api.transport
 
-	if !tunnel.isActive() {
-		fmt.Printf("Creating tunnel")
-		_, err = server.cloud.OpenSecureTunnel(
-			server.instanceName, server.zone, server.tunnelPort, server.dockerPort)
-		if err != nil {
-			return err
-		}
+	if isHijackRequest(r) {
+		return hijackRequest(transport, targetUrl, r, w)
+	}
+
+	if rewrite := server.portRewriter(r, instance); rewrite != nil {
+		return proxyRewrite(transport, targetUrl, r, w, rewrite)
 	}
+	return proxyRequest(transport, targetUrl, r, w)
+}
 
-	err = proxyRequest(targetUrl, r, w)
+// Answers a ping the way the daemon does, in the API version the proxy speaks
+// to daemons, so that clients settle on it before there is a daemon to ask.
+func writePing(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Api-Version", maxAPIVersion)
+	w.Header().Set("Ostype", "linux")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Pragma", "no-cache")
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "GET" {
+		fmt.Fprint(w, "OK")
+	}
+}
+
+// Returns the instance and its docker daemon, or nil if there is no instance
+// running. Unlike requests, it doesn't bring an instance up, nor does it count
+// as activity.
+func (server *ProxyServer) daemon(ctx context.Context) (dockercloud.Instance, *daemonAPI, error) {
+	slot := server.instanceSlot()
+	instance, err := slot.get(ctx, false)
+	if err != nil || instance == nil {
+		return nil, nil, err
+	}
+	api, err := server.openTunnel(ctx, instance)
 	if err != nil {
-		return err
+		slot.invalidate(instance)
+		return nil, nil, err
 	}
-	if strings.HasSuffix(path, "/stop") {
-		server.maybeDelete(host, server.instanceName, server.zone)
+	return instance, api, nil
+}
+
+// Returns the slot tracking the VM instance.
+func (server *ProxyServer) instanceSlot() *instanceSlot {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.slot == nil {
+		server.slot = newInstanceSlot(server.instanceName, server.provider, server.createTimeout, server.pool)
 	}
-	return nil
+	return server.slot
+}
+
+// Opens the tunnel to the docker daemon on instance, unless a healthy one is
+// already up, and settles on the API version to speak to the daemon. Returns
+// the daemon as reached through the tunnel. The tunnel is dialed without
+// holding mu, so that other requests don't wait on it.
+func (server *ProxyServer) openTunnel(ctx context.Context, instance dockercloud.Instance) (*daemonAPI, error) {
+	if api := server.currentTunnel(instance); api != nil {
+		return api, nil
+	}
+	log.Printf("Creating tunnel")
+	tunnel, err := instance.OpenTunnel(ctx)
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return tunnel.Dial(ctx, server.dockerPort)
+		},
+	}
+	version, err := negotiateVersion(ctx, transport)
+	if err != nil {
+		transport.CloseIdleConnections()
+		tunnel.Close()
+		return nil, err
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.tunnel != nil && server.tunnelInstance == instance && server.tunnel.Healthy() {
+		// Another request got there first, use its tunnel.
+		transport.CloseIdleConnections()
+		tunnel.Close()
+		return &daemonAPI{server.transport, server.apiVersion}, nil
+	}
+	server.closeTunnelLocked()
+	server.tunnel, server.tunnelInstance = tunnel, instance
+	server.transport, server.apiVersion = transport, version
+	return &daemonAPI{transport, version}, nil
 }
 
-func proxyRequest(url string, r *http.Request, w http.ResponseWriter) error {
-	var res *http.Response
-	var err error
+// Returns the daemon on instance as reached through the tunnel, if a healthy
+// one is up.
+func (server *ProxyServer) currentTunnel(instance dockercloud.Instance) *daemonAPI {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.tunnel == nil || server.tunnelInstance != instance || !server.tunnel.Healthy() {
+		return nil
+	}
+	return &daemonAPI{server.transport, server.apiVersion}
+}
 
-	// Proxy the request.
-	if r.Method == "GET" {
-		res, err = http.Get(url)
+// Closes the tunnel to the docker daemon, if there is one.
+func (server *ProxyServer) closeTunnel() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.closeTunnelLocked()
+}
+
+func (server *ProxyServer) closeTunnelLocked() {
+	if server.tunnel != nil {
+		server.transport.CloseIdleConnections()
+		server.tunnel.Close()
+		server.tunnel, server.tunnelInstance = nil, nil
+		server.transport, server.apiVersion = nil, ""
+	}
+}
+
+// Hop-by-hop headers. These are meaningful only for a single transport-level
+// connection and are not forwarded by the proxy.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Copies all of the headers in src into dst, leaving out hop-by-hop headers.
+func copyHeader(dst, src http.Header) {
+	for k, vv := range src {
+		for _, v := range vv {
+			dst.Add(k, v)
+		}
+	}
+	// So are the headers the Connection header names.
+	for _, v := range src["Connection"] {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				dst.Del(h)
+			}
+		}
 	}
-	if r.Method == "POST" {
-		res, err = http.Post(url, "application/json", r.Body)
+	for _, h := range hopHeaders {
+		dst.Del(h)
 	}
+}
+
+// Wraps a ResponseWriter and flushes it after every write, so chunks of a
+// streamed response (logs -f, events, pull progress) reach the client as
+// soon as the daemon sends them.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// Forwards r to url, whatever its method, and streams the response back to
+// w. Headers, query and body are passed through untouched, and request
+// bodies of unknown length are sent on chunked. The upstream request is
+// cancelled as soon as the client goes away. Only returns an error if the
+// response didn't get under way.
+func proxyRequest(transport http.RoundTripper, url string, r *http.Request, w http.ResponseWriter) error {
+	res, err := forwardRequest(transport, url, r)
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
+	copyHeader(w.Header(), res.Header)
 	w.WriteHeader(res.StatusCode)
+	// Streams such as events may not say anything for a while, let the
+	// client know they are on.
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	_, err = io.Copy(flushWriter{w}, res.Body)
+	// Once the response is under way it is too late to report an error to
+	// the client, and if the client hung up there's nobody left to report to.
+	if err != nil && r.Context().Err() == nil {
+		log.Printf("Error streaming %s %s: %v", r.Method, r.URL.Path, err)
+	}
+	return nil
+}
+
+// Like proxyRequest, but passes the JSON of a successful response through
+// rewrite on the way back.
+func proxyRewrite(transport http.RoundTripper, url string, r *http.Request, w http.ResponseWriter, rewrite func(interface{})) error {
+	res, err := forwardRequest(transport, url, r)
+	if err != nil {
+		return err
+	}
 	defer res.Body.Close()
-	// TODO(bburns) : Intercept 'ps' here and substitute in the ip address.
-	_, err = io.Copy(w, res.Body)
-	return err
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode == http.StatusOK {
+		var v interface{}
+		if err := decodeJSON(body, &v); err != nil {
+			return err
+		}
+		rewrite(v)
+		if body, err = json.Marshal(v); err != nil {
+			return err
+		}
+		res.Header.Del("Content-Length")
+	}
+	copyHeader(w.Header(), res.Header)
+	w.WriteHeader(res.StatusCode)
+	if _, err = w.Write(body); err != nil {
+		log.Printf("Error writing %s %s: %v", r.Method, r.URL.Path, err)
+	}
+	return nil
+}
+
+// Sends r on to url, and returns the response.
+func forwardRequest(transport http.RoundTripper, url string, r *http.Request) (*http.Response, error) {
+	body := r.Body
+	if r.ContentLength == 0 {
+		body = nil
+	}
+	req, err := http.NewRequest(r.Method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	copyHeader(req.Header, r.Header)
+	req.ContentLength = r.ContentLength
+	req = req.WithContext(r.Context())
+
+	// Use the transport directly, redirects are the client's business.
+	return transport.RoundTrip(req)
 }
 
 // TODO(bburns) : clone this from docker somehow?
@@ -160,8 +406,18 @@ type ContainerStatus struct {
 	SizeRootFs float64
 }
 
-func (server ProxyServer) maybeDelete(host string, instanceName string, zone string) error {
-	res, err := http.Get(fmt.Sprintf("http://%s/v1.6/containers/json", host))
+// Asks the docker daemon for path, and decodes the response into v.
+func getJSON(ctx context.Context, transport http.RoundTripper, path string, v interface{}) error {
+	return requestJSON(ctx, transport, "GET", path, v)
+}
+
+// Like getJSON, with method rather than GET and an empty body.
+func requestJSON(ctx context.Context, transport http.RoundTripper, method, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://%s%s", dockerHost, path), nil)
+	if err != nil {
+		return err
+	}
+	res, err := transport.RoundTrip(req)
 	if err != nil {
 		return err
 	}
@@ -170,19 +426,92 @@ func (server ProxyServer) maybeDelete(host string, instanceName string, zone str
 	if err != nil {
 		return err
 	}
-	fmt.Printf(string(body))
+	if res.StatusCode != http.StatusOK {
+		return &daemonError{res.StatusCode, strings.TrimSpace(string(body))}
+	}
+	return decodeJSON(body, v)
+}
+
+// The docker daemon on an instance, as reached through the tunnel.
+type daemonAPI struct {
+	transport *http.Transport
+	// The API version the proxy's own requests use, empty to use the
+	// daemon's own.
+	version string
+}
+
+// Asks the daemon for path, in the API version negotiated with it, and
+// decodes the response into v.
+func (api *daemonAPI) getJSON(ctx context.Context, path string, v interface{}) error {
+	return getJSON(ctx, api.transport, api.path(path), v)
+}
+
+// Returns path, prefixed with the API version negotiated with the daemon.
+func (api *daemonAPI) path(path string) string {
+	if api.version == "" {
+		return path
+	}
+	return "/v" + api.version + path
+}
+
+// Decodes data into v, keeping numbers as they are, so that they make it
+// through a round trip untouched.
+func decodeJSON(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// An error response from the docker daemon.
+type daemonError struct {
+	StatusCode int
+	Message    string
+}
+
+func (err *daemonError) Error() string {
+	return fmt.Sprintf("docker daemon: %d %s", err.StatusCode, err.Message)
+}
+
+// What to do with an idle instance.
+const (
+	// Delete it, the next request creates a new one from scratch.
+	idleDelete = "delete"
+	// Stop it, the next request starts it again with its disk as it was.
+	idleStop = "stop"
+	// Suspend it, the next request resumes it with its memory as it was.
+	idleSuspend = "suspend"
+)
+
+// Tears the instance down according to the idle policy, unless it runs
+// containers.
+func (server *ProxyServer) maybeShutdown(ctx context.Context, api *daemonAPI, instance dockercloud.Instance) error {
 	var containers []ContainerStatus
-	err = json.Unmarshal(body, &containers)
-	if err != nil {
+	if err := api.getJSON(ctx, "/containers/json", &containers); err != nil {
 		return err
 	}
-	if len(containers) == 0 {
-		err = server.cloud.DeleteInstance(instanceName, zone)
-		if err != nil {
-			return err
-		}
+	if len(containers) > 0 {
+		return nil
 	}
-	return nil
+	policy := server.idlePolicy
+	if policy == "" {
+		policy = idleDelete
+	}
+	// Requests may have come in while the containers were listed.
+	return server.instanceSlot().shutdown(ctx, instance, policy != idleDelete, server.idleTimedOut, func(ctx context.Context, instance dockercloud.Instance) error {
+		log.Printf("Shutting idle instance %q down: %s", instance.Name(), policy)
+		server.closeTunnel()
+		switch policy {
+		case idleStop:
+			return instance.Stop(ctx)
+		case idleSuspend:
+			if suspender, ok := instance.(dockercloud.Suspender); ok {
+				return suspender.Suspend(ctx)
+			}
+			// Stopping is the next best thing.
+			return instance.Stop(ctx)
+		}
+		return instance.Delete(ctx)
+	})
 }
 
 // Starts the authorization wizard to retrieve
@@ -211,47 +540,281 @@ func (cmd *authCmd) Run(args []string) {
 // Starts a Docker proxy server to intecept the Docker commands
 // to create and delete VMs on demand.
 type startCmd struct {
-	proxyPort    *int
-	dockerPort   *int
-	tunnelPort   *int
-	instanceName *string
-	zone         *string
-	projectId    *string
+	proxyPort     *int
+	listen        listenAddrs
+	socketMode    *string
+	tls           *bool
+	tlsVerify     *bool
+	tlsCACert     *string
+	tlsCert       *string
+	tlsKey        *string
+	dockerPort    *int
+	instanceName  *string
+	createTimeout *time.Duration
+	idleTimeout   *time.Duration
+	idlePolicy    *string
+	poolSize      *int
+	poolMaxAge    *time.Duration
+	routeBy       *string
+	maxClients    *int
+	maxInstances  *int
+	containerCpus *float64
+	containerMem  *int64
+	forwardPorts  *bool
+	exposePorts   *bool
+	policyFile    *string
+	provider      dockercloud.ProviderFactory
+	providerName  *string
 }
 
 // Defines the flags required by start subcommand.
 func (cmd *startCmd) Flags(fs *flag.FlagSet) *flag.FlagSet {
-	cmd.proxyPort = fs.Int("port", 8080, "The local port to run on.")
+	cmd.proxyPort = fs.Int("port", 8080, "The port to listen on at 127.0.0.1, unless -listen is given.")
+	fs.Var(&cmd.listen, "listen",
+		"Where to listen, unix:///path/to/socket or tcp://host:port, may be given several times; defaults to 127.0.0.1 on the -port")
+	cmd.socketMode = fs.String("socketmode", "0600", "The permissions of the unix sockets listened on")
+	certsDir := defaultCertsDir()
+	cmd.tls = fs.Bool("tls", false, "Serve TLS on TCP addresses, implied by -tlsverify")
+	cmd.tlsVerify = fs.Bool("tlsverify", false, "Serve TLS on TCP addresses, and only let in clients with a certificate signed by the CA")
+	cmd.tlsCACert = fs.String("tlscacert", path.Join(certsDir, caCertFile), "The CA client certificates must be signed by")
+	cmd.tlsCert = fs.String("tlscert", path.Join(certsDir, serverCertFile), "The TLS certificate of the proxy")
+	cmd.tlsKey = fs.String("tlskey", path.Join(certsDir, serverKeyFile), "The TLS key of the proxy")
 	cmd.dockerPort = fs.Int("dockerport", 8000, "The remote port to run docker on")
-	cmd.tunnelPort = fs.Int("tunnelport", 8001, "The local port open the tunnel to docker")
 	cmd.instanceName = fs.String("instancename", "docker-instance", "The name of the instance")
-	cmd.zone = fs.String("zone", "us-central1-a", "The zone to run in")
-	cmd.projectId = fs.String("project", "", "Google Cloud Project Name")
+	cmd.createTimeout = fs.Duration("timeout", 15*time.Minute, "How long to wait for a new instance, 0 for no limit")
+	cmd.idleTimeout = fs.Duration("idletimeout", 30*time.Minute,
+		"How long the instance may run no containers and serve no requests before it is shut down, 0 to keep it")
+	cmd.idlePolicy = fs.String("idlepolicy", idleDelete,
+		"What to do with an idle instance: delete it, stop it or suspend it, restarting it on the next request")
+	cmd.poolSize = fs.Int("poolsize", 0, "How many ready instances to keep around for new instances to be taken from")
+	cmd.poolMaxAge = fs.Duration("poolmaxage", 6*time.Hour,
+		"How long an instance may wait in the pool before it is replaced with a fresh one, 0 to keep it")
+	cmd.maxInstances = fs.Int("maxinstances", 1, "How many instances to spread containers over, adding one when the others are full")
+	cmd.containerCpus = fs.Float64("containercpus", 0.5, "How many CPUs a container takes up when scheduling, unless it asks for some")
+	cmd.containerMem = fs.Int64("containermemory", 512, "How many MB of memory a container takes up when scheduling, unless it asks for some")
+	cmd.forwardPorts = fs.Bool("forwardports", true, "Forward the ports containers publish to the same ports on localhost, unless clients are routed with -routeby")
+	cmd.exposePorts = fs.Bool("exposeports", false, "Open the ports containers publish to the outside world on the instance, where the provider supports it")
+	cmd.policyFile = fs.String("policy", "", "A JSON file restricting what clients may ask the docker daemon for")
+	cmd.routeBy = fs.String("routeby", "",
+		"Give each client its own instance, telling clients apart by: cert (the client certificate name), token (the bearer token) or header:Name (the Name header); all clients share the instance if unset")
+	cmd.maxClients = fs.Int("maxclients", 10, "How many clients routed with -routeby may have instances at once")
+	cmd.providerName = fs.String("provider", defaultProvider,
+		"The cloud to run in, one of: "+strings.Join(dockercloud.ProviderNames(), ", "))
+	// The flags are not parsed yet, so peek at the provider to only define
+	// the flags that are relevant to it.
+	name, ok := flagValue(os.Args[1:], "provider")
+	if !ok {
+		name = defaultProvider
+	}
+	if factory, err := dockercloud.LookupProvider(name); err == nil {
+		factory.Flags(fs)
+		cmd.provider = factory
+	}
 	return fs
 }
 
+const defaultProvider = "gce"
+
+// Returns the value flag name is set to in args, if it is set at all.
+func flagValue(args []string, name string) (string, bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			// The flags end here.
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		arg = strings.TrimLeft(arg, "-")
+		if arg == name {
+			if i+1 < len(args) && !strings.HasPrefix(args[i+1], "-") {
+				return args[i+1], true
+			}
+			return "", false
+		}
+		if strings.HasPrefix(arg, name+"=") {
+			return arg[len(name)+1:], true
+		}
+	}
+	return "", false
+}
+
 // Handles the start command.
 func (cmd *startCmd) Run(args []string) {
-	gce, err := dockercloud.NewCloudGCE(*cmd.projectId)
+	if cmd.provider == nil {
+		_, err := dockercloud.LookupProvider(*cmd.providerName)
+		log.Fatal(err)
+	}
+	switch *cmd.idlePolicy {
+	case idleDelete, idleStop, idleSuspend:
+	default:
+		log.Fatalf("Unknown idle policy %q, pick one of: %s, %s, %s", *cmd.idlePolicy, idleDelete, idleStop, idleSuspend)
+	}
+	if *cmd.poolSize < 0 {
+		log.Fatalf("Invalid pool size %d", *cmd.poolSize)
+	}
+	if *cmd.maxInstances < 1 {
+		log.Fatalf("Invalid max instances %d", *cmd.maxInstances)
+	}
+	socketMode, err := parseSocketMode(*cmd.socketMode)
 	if err != nil {
 		log.Fatal(err)
 	}
-	http.Handle("/", ProxyServer{
-		instanceName: *cmd.instanceName,
-		zone:         *cmd.zone,
-		dockerPort:   *cmd.dockerPort,
-		tunnelPort:   *cmd.tunnelPort,
-		cloud:        gce,
-	})
-	addr := fmt.Sprintf(":%d", *cmd.proxyPort)
-	log.Printf("Server started, now you can use docker -H tcp://localhost%s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	var tlsConfig *tls.Config
+	if *cmd.tls || *cmd.tlsVerify {
+		tlsConfig, err = serverTLSConfig(*cmd.tlsCACert, *cmd.tlsCert, *cmd.tlsKey, *cmd.tlsVerify)
+		if err != nil {
+			log.Fatalf("Error setting TLS up: %v, generate the certificates with docker-cloud certs", err)
+		}
+	}
+	var keyOf func(*http.Request) (string, error)
+	var secretKeys bool
+	if *cmd.routeBy != "" {
+		var err error
+		keyOf, secretKeys, err = routeKeyFunc(*cmd.routeBy)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *cmd.routeBy == routeByCert && !*cmd.tlsVerify {
+			log.Fatal("Routing by client certificate needs -tlsverify")
+		}
+		if *cmd.maxClients < 1 {
+			log.Fatalf("Invalid max clients %d", *cmd.maxClients)
+		}
+	}
+	var pol *policy
+	if *cmd.policyFile != "" {
+		pol, err = loadPolicy(*cmd.policyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	provider, err := cmd.provider.New()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var pool *instancePool
+	if *cmd.poolSize > 0 {
+		pool = newInstancePool(provider, *cmd.instanceName+"-pool-", *cmd.poolSize, *cmd.poolMaxAge, *cmd.createTimeout)
+	}
+	// Ctrl-C aborts whatever the requests in flight are doing.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	newProxy := func(ctx context.Context, instanceName string) *ProxyServer {
+		proxy := &ProxyServer{
+			instanceName:  instanceName,
+			dockerPort:    *cmd.dockerPort,
+			createTimeout: *cmd.createTimeout,
+			idleTimeout:   *cmd.idleTimeout,
+			idlePolicy:    *cmd.idlePolicy,
+			provider:      provider,
+			pool:          pool,
+			policy:        pol,
+		}
+		go proxy.reapIdle(ctx)
+		// Clients of a shared proxy are on other machines.
+		if *cmd.forwardPorts && keyOf == nil {
+			proxy.forwards = newPortForwards(proxy.dialPort)
+		}
+		proxy.exposePorts = *cmd.exposePorts
+		if proxy.forwards != nil || proxy.exposePorts {
+			go proxy.watchPorts(ctx)
+		}
+		return proxy
+	}
+	newBackend := func(ctx context.Context, instanceName string) backend {
+		if *cmd.maxInstances == 1 {
+			return newProxy(ctx, instanceName)
+		}
+		f := newFleet(instanceName, provider, *cmd.maxInstances, *cmd.containerCpus, *cmd.containerMem<<20, func(name string) *ProxyServer {
+			return newProxy(ctx, name)
+		})
+		f.policy = pol
+		return f
+	}
+	var handler interface {
+		http.Handler
+		closeTunnel()
+	}
+	if keyOf == nil {
+		handler = newBackend(ctx, *cmd.instanceName)
+	} else {
+		handler = newRouter(ctx, keyOf, *cmd.maxClients, func(ctx context.Context, key string) backend {
+			name := routedInstanceName(*cmd.instanceName, key, secretKeys)
+			log.Printf("Routing a new client to instance %q", name)
+			return newBackend(ctx, name)
+		})
+	}
+	addrs := cmd.listen
+	if len(addrs) == 0 {
+		addrs = listenAddrs{fmt.Sprintf("127.0.0.1:%d", *cmd.proxyPort)}
+	}
+	var listeners []net.Listener
+	for _, addr := range addrs {
+		l, hostFlag, err := listen(addr, socketMode, tlsConfig)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			log.Fatalf("Error listening on %s: %v", addr, err)
+		}
+		listeners = append(listeners, l)
+		if tcp, ok := l.Addr().(*net.TCPAddr); ok && !tcp.IP.IsLoopback() && !*cmd.tlsVerify {
+			if keyOf != nil {
+				// Anyone could make up a header or token, and get
+				// instances of their own.
+				for _, l := range listeners {
+					l.Close()
+				}
+				log.Fatalf("Routing by %s doesn't tell who clients are, listen on localhost or use -tlsverify to listen on %s", *cmd.routeBy, addr)
+			}
+			log.Printf("Warning: anyone who can reach %s can run containers on your instances, consider -tlsverify", addr)
+		}
+		log.Printf("Server started, now you can use docker -H %s", hostFlag)
+	}
+	server := &http.Server{
+		Handler:     handler,
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	var poolDone chan struct{}
+	if pool != nil {
+		poolDone = make(chan struct{})
+		go func() {
+			defer close(poolDone)
+			pool.run(ctx)
+		}()
+	}
+	served := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			served <- server.Serve(l)
+		}(l)
+	}
+	if err := <-served; err != http.ErrServerClosed {
+		// Closing the server closes every listener, removing the sockets.
+		server.Close()
+		log.Fatal(err)
+	}
+	handler.closeTunnel()
+	if pool != nil {
+		// Let a second Ctrl-C interrupt the cleanup.
+		stop()
+		<-poolDone
+		pool.drain(context.Background())
+	}
 }
 
 func main() {
 	// Registers authCmd to handle `program [args...] auth [subcommand-args...]`
-	command.On("auth", "Allow you to authorize and configure project settings.", &authCmd{}, []string{"project"})
+	onCommand("auth", "Allow you to authorize and configure project settings.", &authCmd{}, []string{"project"})
 	// Registers startCmd to handle `program [args...] start [subcommand-args...]`
-	command.On("start", "Starts the proxy server.", &startCmd{}, []string{})
-	command.ParseAndRun()
+	onCommand("start", "Starts the proxy server.", &startCmd{}, []string{})
+	// Registers certsCmd to handle `program [args...] certs [subcommand-args...]`
+	onCommand("certs", "Generates the certificates securing the proxy with TLS.", &certsCmd{}, []string{})
+	parseAndRun()
 }
@@ -0,0 +1,1838 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/googlecloudplatform/docker-cloud/dockercloud"
+)
+
+func newTestProxy(cloud *dockercloud.FakeCloud) (*ProxyServer, *httptest.Server) {
+	server := &ProxyServer{
+		instanceName:  "docker-instance",
+		dockerPort:    8000,
+		createTimeout: 5 * time.Second,
+		provider:      cloud,
+	}
+	return server, httptest.NewServer(server)
+}
+
+func do(t *testing.T, method, url, body string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.StatusCode, string(data)
+}
+
+func TestDoServeListWithoutInstance(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+
+	status, body := do(t, "GET", ts.URL+"/v1.6/containers/json", "")
+	if status != 200 || body != "[]" {
+		t.Errorf("got %d %q, want 200 []", status, body)
+	}
+	if n := len(cloud.Instances()); n != 0 {
+		t.Errorf("listing containers created %d instances", n)
+	}
+}
+
+func TestDoServePingWithoutInstance(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+	ctx := context.Background()
+
+	status, body := do(t, "GET", ts.URL+"/_ping", "")
+	if status != 200 || body != "OK" {
+		t.Errorf("got %d %q, want 200 OK", status, body)
+	}
+	res, err := http.Head(ts.URL + "/v1.41/_ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("Api-Version") != maxAPIVersion {
+		t.Errorf("HEAD: got %d with API version %q, want 200 with %s", res.StatusCode, res.Header.Get("Api-Version"), maxAPIVersion)
+	}
+	if n := len(cloud.Instances()); n != 0 {
+		t.Errorf("pinging created %d instances", n)
+	}
+
+	// Nor does it start a stopped instance.
+	instance, err := cloud.CreateInstance(ctx, "docker-instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := instance.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+	status, body = do(t, "GET", ts.URL+"/_ping", "")
+	if status != 200 || body != "OK" {
+		t.Errorf("got %d %q, want 200 OK", status, body)
+	}
+	if instance, err = cloud.GetInstance(ctx, "docker-instance"); err != nil {
+		t.Fatal(err)
+	}
+	if instance.Status() != dockercloud.StatusStopped {
+		t.Errorf("got status %s, want %s", instance.Status(), dockercloud.StatusStopped)
+	}
+}
+
+func TestDoServeCreatesInstance(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	cloud.Latency = 10 * time.Millisecond
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+
+	status, body := do(t, "POST", ts.URL+"/v1.6/containers/create", `{"Image": "busybox"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create: got %d %q", status, body)
+	}
+	if names := cloud.Instances(); len(names) != 1 || names[0] != "docker-instance" {
+		t.Errorf("got instances %v, want [docker-instance]", names)
+	}
+	status, body = do(t, "GET", ts.URL+"/v1.6/containers/json?all=1", "")
+	if status != 200 || !strings.Contains(body, "busybox") {
+		t.Errorf("list: got %d %q", status, body)
+	}
+}
+
+func TestDoServeKeepsEscapedPath(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	var mu sync.Mutex
+	var uris []string
+	cloud.NewDaemon = func() http.Handler {
+		daemon := dockercloud.NewFakeDaemon()
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.Contains(r.URL.Path, "/images/") {
+				mu.Lock()
+				uris = append(uris, r.RequestURI)
+				mu.Unlock()
+			}
+			daemon.ServeHTTP(w, r)
+		})
+	}
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+
+	want := []string{
+		"/v1.24/images/registry%2Fweird%3Fname/json",
+		"/v1.24/images/json?all=1",
+	}
+	for _, uri := range want {
+		do(t, "GET", ts.URL+uri, "")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(uris, want) {
+		t.Errorf("daemon got %q, want %q", uris, want)
+	}
+}
+
+func TestDoServeConcurrentCreate(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	cloud.Latency = 50 * time.Millisecond
+	var mu sync.Mutex
+	creates := 0
+	cloud.Fail = func(op, name string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		if op == "create" {
+			creates++
+		}
+		return nil
+	}
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status, body := do(t, "POST", ts.URL+"/v1.6/containers/create", `{"Image": "busybox"}`)
+			if status != http.StatusCreated {
+				t.Errorf("create: got %d %q", status, body)
+			}
+		}()
+	}
+	wg.Wait()
+	if creates != 1 {
+		t.Errorf("got %d instance creations, want 1", creates)
+	}
+}
+
+func TestDoServeCreateFailure(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	cloud.Fail = func(op, name string) error {
+		if op == "create" {
+			return errors.New("quota exceeded")
+		}
+		return nil
+	}
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+
+	status, body := do(t, "POST", ts.URL+"/v1.6/containers/create", `{"Image": "busybox"}`)
+	if status != 500 || !strings.Contains(body, "quota exceeded") {
+		t.Errorf("got %d %q, want 500 with the cloud error", status, body)
+	}
+}
+
+func TestDoServeWaitsForBootingInstance(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	ready := make(chan struct{})
+	var waits int32
+	cloud.Fail = func(op, name string) error {
+		if op == "wait" {
+			atomic.AddInt32(&waits, 1)
+			<-ready
+		}
+		return nil
+	}
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+	ctx := context.Background()
+	// Another proxy is booting the instance.
+	if _, err := cloud.CreateInstance(ctx, "docker-instance"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cloud.SetStatus("docker-instance", "STAGING"); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan string)
+	go func() {
+		status, body := do(t, "GET", ts.URL+"/v1.6/info", "")
+		done <- fmt.Sprint(status, " ", body)
+	}()
+	select {
+	case res := <-done:
+		t.Fatalf("got %s before the instance was up", res)
+	case <-time.After(2 * statusPollInterval):
+	}
+	cloud.SetStatus("docker-instance", dockercloud.StatusRunning)
+	close(ready)
+	if res := <-done; !strings.HasPrefix(res, "200 ") {
+		t.Errorf("got %s once the instance was up", res)
+	}
+	if atomic.LoadInt32(&waits) == 0 {
+		t.Error("didn't wait for docker on the booting instance")
+	}
+}
+
+func TestDoServeWaitsForStoppingInstance(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+	ctx := context.Background()
+	if _, err := cloud.CreateInstance(ctx, "docker-instance"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cloud.SetStatus("docker-instance", "STOPPING"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(2 * statusPollInterval)
+		cloud.SetStatus("docker-instance", dockercloud.StatusStopped)
+	}()
+
+	// Once it is down, it is started again.
+	status, body := do(t, "GET", ts.URL+"/v1.6/info", "")
+	if status != 200 {
+		t.Errorf("got %d %q", status, body)
+	}
+	instance, err := cloud.GetInstance(ctx, "docker-instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if instance.Status() != dockercloud.StatusRunning {
+		t.Errorf("got status %s, want %s", instance.Status(), dockercloud.StatusRunning)
+	}
+}
+
+func createContainer(t *testing.T, url string) string {
+	status, body := do(t, "POST", url+"/v1.6/containers/create", `{"Image": "busybox"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create: got %d %q", status, body)
+	}
+	id := body[strings.Index(body, `"Id":"`)+6:]
+	return id[:strings.Index(id, `"`)]
+}
+
+func TestReapIfIdle(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+	ctx := context.Background()
+
+	id := createContainer(t, ts.URL)
+	if status, body := do(t, "POST", ts.URL+"/v1.6/containers/"+id+"/start", ""); status != http.StatusNoContent {
+		t.Fatalf("start: got %d %q", status, body)
+	}
+	if status, body := do(t, "POST", ts.URL+"/v1.6/containers/"+id+"/stop", ""); status != http.StatusNoContent {
+		t.Fatalf("stop: got %d %q", status, body)
+	}
+
+	server.idleTimeout = time.Hour
+	if err := server.reapIfIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cloud.Instances()); n != 1 {
+		t.Errorf("got %d instances before the idle timeout, want 1", n)
+	}
+
+	server.idleTimeout = time.Nanosecond
+	if err := server.reapIfIdle(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cloud.Instances()); n != 0 {
+		t.Errorf("got %d instances once idle, want 0", n)
+	}
+
+	// The next request brings a new instance up.
+	createContainer(t, ts.URL)
+	if n := len(cloud.Instances()); n != 1 {
+		t.Errorf("got %d instances after a new request, want 1", n)
+	}
+}
+
+func TestReapIfIdleStopPolicy(t *testing.T) {
+	for _, policy := range []string{idleStop, idleSuspend} {
+		cloud := dockercloud.NewFakeCloud()
+		server, ts := newTestProxy(cloud)
+		server.idlePolicy = policy
+		server.idleTimeout = time.Nanosecond
+		ctx := context.Background()
+
+		id := createContainer(t, ts.URL)
+		if err := server.reapIfIdle(ctx); err != nil {
+			t.Fatal(err)
+		}
+		instance, err := cloud.GetInstance(ctx, "docker-instance")
+		if err != nil {
+			t.Fatalf("%s: %v", policy, err)
+		}
+		if instance.Status() == dockercloud.StatusRunning {
+			t.Errorf("%s: instance still running once idle", policy)
+		}
+
+		// The next request restarts it, containers and all.
+		status, body := do(t, "GET", ts.URL+"/v1.6/containers/"+id+"/json", "")
+		if status != 200 || !strings.Contains(body, id) {
+			t.Errorf("%s: inspect after restart: got %d %q", policy, status, body)
+		}
+		instance, _ = cloud.GetInstance(ctx, "docker-instance")
+		if instance.Status() != dockercloud.StatusRunning {
+			t.Errorf("%s: got status %s after a new request, want %s", policy, instance.Status(), dockercloud.StatusRunning)
+		}
+		server.closeTunnel()
+		ts.Close()
+	}
+}
+
+func TestReapIfIdleKeepsRunningContainers(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+
+	id := createContainer(t, ts.URL)
+	do(t, "POST", ts.URL+"/v1.6/containers/"+id+"/start", "")
+
+	server.idleTimeout = time.Nanosecond
+	if err := server.reapIfIdle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cloud.Instances()); n != 1 {
+		t.Errorf("got %d instances with a container running, want 1", n)
+	}
+}
+
+func TestMaybeShutdownKeepsBusyInstance(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	daemon := dockercloud.NewFakeDaemon()
+	cloud.NewDaemon = func() http.Handler { return daemon }
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+
+	_, body := do(t, "POST", ts.URL+"/v1.6/containers/create", `{"Image": "busybox"}`)
+	id := body[strings.Index(body, `"Id":"`)+6:]
+	id = id[:strings.Index(id, `"`)]
+	do(t, "POST", ts.URL+"/v1.6/containers/"+id+"/start", "")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	instance, err := cloud.GetInstance(req.Context(), "docker-instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	transport, err := server.openTunnel(req.Context(), instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.maybeShutdown(req.Context(), transport, instance); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cloud.Instances()); n != 1 {
+		t.Errorf("got %d instances with a container running, want 1", n)
+	}
+	if c := daemon.Containers(); len(c) != 1 || !c[0].Running {
+		t.Errorf("got containers %v, want one running", c)
+	}
+}
+
+func TestMaybeShutdownKeepsInstanceServingRequests(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+	ctx := context.Background()
+	id := createContainer(t, ts.URL)
+	do(t, "DELETE", ts.URL+"/v1.6/containers/"+id, "")
+
+	instance, err := server.instanceSlot().get(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := server.openTunnel(ctx, instance)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A request comes in after the reaper found the proxy idle.
+	server.beginRequest()
+	if err := server.maybeShutdown(ctx, api, instance); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cloud.Instances()); n != 1 {
+		t.Errorf("got %d instances with a request in flight, want 1", n)
+	}
+	server.endRequest()
+	if err := server.maybeShutdown(ctx, api, instance); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cloud.Instances()); n != 0 {
+		t.Errorf("got %d instances once the request ended, want 0", n)
+	}
+}
+
+func TestProxyRequestForwardsEverything(t *testing.T) {
+	var got *http.Request
+	var gotBody string
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, _ := ioutil.ReadAll(r.Body)
+		got, gotBody = r, string(data)
+		w.Header().Set("X-Docker", "yes")
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte("done"))
+	}))
+	defer daemon.Close()
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := proxyRequest(http.DefaultTransport, daemon.URL+r.URL.Path+"?"+r.URL.RawQuery, r, w); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer proxy.Close()
+
+	req, _ := http.NewRequest("PUT", proxy.URL+"/v1.24/containers/abc/archive?path=/tmp", strings.NewReader("tarball"))
+	req.Header.Set("Content-Type", "application/x-tar")
+	req.Header.Set("X-Registry-Auth", "secret")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := ioutil.ReadAll(res.Body)
+
+	if got.Method != "PUT" || got.URL.Path != "/v1.24/containers/abc/archive" || got.URL.RawQuery != "path=/tmp" {
+		t.Errorf("got %s %s, want PUT with path and query intact", got.Method, got.URL)
+	}
+	if got.Header.Get("Content-Type") != "application/x-tar" || got.Header.Get("X-Registry-Auth") != "secret" {
+		t.Errorf("headers were not forwarded: %v", got.Header)
+	}
+	if gotBody != "tarball" {
+		t.Errorf("got body %q, want tarball", gotBody)
+	}
+	if res.StatusCode != http.StatusAccepted || res.Header.Get("X-Docker") != "yes" || string(body) != "done" {
+		t.Errorf("got response %d %v %q", res.StatusCode, res.Header, body)
+	}
+}
+
+func TestCopyHeaderDropsHopHeaders(t *testing.T) {
+	src := http.Header{
+		"Connection":      {"keep-alive, X-Hop"},
+		"X-Hop":           {"1"},
+		"Trailer":         {"X-Checksum"},
+		"Keep-Alive":      {"timeout=5"},
+		"X-Registry-Auth": {"secret"},
+	}
+	dst := http.Header{}
+	copyHeader(dst, src)
+	if len(dst) != 1 || dst.Get("X-Registry-Auth") != "secret" {
+		t.Errorf("got headers %v, want only X-Registry-Auth", dst)
+	}
+}
+
+// Starts a server proxying every request to daemon the way ProxyServer does.
+func newStreamingProxy(t *testing.T, daemon *httptest.Server) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := proxyRequest(http.DefaultTransport, daemon.URL+r.URL.Path, r, w); err != nil {
+			writeError(w, 500, err)
+		}
+	}))
+}
+
+func TestProxyRequestStreams(t *testing.T) {
+	release := make(chan struct{})
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("first\n"))
+		w.(http.Flusher).Flush()
+		<-release
+		w.Write([]byte("second\n"))
+	}))
+	defer daemon.Close()
+	proxy := newStreamingProxy(t, daemon)
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL + "/v1.24/containers/abc/logs?follow=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	// The daemon is still at it, yet the first chunk is there.
+	reader := bufio.NewReader(res.Body)
+	if line, err := reader.ReadString('\n'); line != "first\n" {
+		t.Fatalf("got %q, %v, want the first line", line, err)
+	}
+	close(release)
+	if rest, _ := ioutil.ReadAll(reader); string(rest) != "second\n" {
+		t.Errorf("got %q, want the second line", rest)
+	}
+}
+
+func TestProxyRequestCancelsUpstream(t *testing.T) {
+	cancelled := make(chan struct{})
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+		close(cancelled)
+	}))
+	defer daemon.Close()
+	proxy := newStreamingProxy(t, daemon)
+	defer proxy.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, "GET", proxy.URL+"/v1.24/events", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The client hangs up.
+	cancel()
+	res.Body.Close()
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Error("the request to the daemon outlived the client")
+	}
+}
+
+func TestProxyRequestBrokenStream(t *testing.T) {
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("partial"))
+		w.(http.Flusher).Flush()
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	defer daemon.Close()
+	proxy := newStreamingProxy(t, daemon)
+	defer proxy.Close()
+
+	res, err := http.Get(proxy.URL + "/v1.24/images/create")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	// Nothing gets tacked onto what already went out.
+	body, _ := ioutil.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || string(body) != "partial" {
+		t.Errorf("got %d %q, want the partial response", res.StatusCode, body)
+	}
+}
+
+func TestProxyRequestHead(t *testing.T) {
+	daemon := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "HEAD" {
+			t.Errorf("got method %s, want HEAD", r.Method)
+		}
+		w.Header().Set("Docker-Experimental", "false")
+	}))
+	defer daemon.Close()
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := proxyRequest(http.DefaultTransport, daemon.URL+r.URL.Path, r, w); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer proxy.Close()
+
+	res, err := http.Head(proxy.URL + "/_ping")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != 200 || res.Header.Get("Docker-Experimental") != "false" {
+		t.Errorf("got %d %v", res.StatusCode, res.Header)
+	}
+}
+
+func TestDoServeTakesInstanceFromPool(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+	server.pool = newInstancePool(cloud, "docker-instance-pool-", 1, 0, 5*time.Second)
+	ctx := context.Background()
+	if err := server.pool.fill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	pooled := cloud.Instances()
+	if len(pooled) != 1 {
+		t.Fatalf("got instances %v after filling the pool, want 1", pooled)
+	}
+
+	createContainer(t, ts.URL)
+	if names := cloud.Instances(); len(names) != 1 || names[0] != pooled[0] {
+		t.Errorf("got instances %v, want the pool instance %v", names, pooled)
+	}
+	select {
+	case <-server.pool.refill:
+	default:
+		t.Error("taking an instance didn't ask for a refill")
+	}
+	if err := server.pool.fill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if names := cloud.Instances(); len(names) != 2 {
+		t.Errorf("got instances %v after refilling the pool, want 2", names)
+	}
+
+	// Only the instances still in the pool are deleted on the way out.
+	server.pool.drain(ctx)
+	if names := cloud.Instances(); len(names) != 1 || names[0] != pooled[0] {
+		t.Errorf("got instances %v after draining the pool, want %v", names, pooled)
+	}
+}
+
+func TestPoolInstanceOutlivesProxy(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+	server.pool = newInstancePool(cloud, "docker-instance-pool-", 1, 0, 5*time.Second)
+	if err := server.pool.fill(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	id := createContainer(t, ts.URL)
+
+	// A restarted proxy, with no pool, finds the instance it was given.
+	server2, ts2 := newTestProxy(cloud)
+	defer ts2.Close()
+	defer server2.closeTunnel()
+	if status, body := do(t, "GET", ts2.URL+"/v1.6/containers/"+id+"/json", ""); status != 200 {
+		t.Errorf("inspect after a restart: got %d %q", status, body)
+	}
+	if names := cloud.Instances(); len(names) != 1 {
+		t.Errorf("got instances %v after a restart, want the pool instance alone", names)
+	}
+
+	// And brings it back up once it is stopped.
+	server2.idleTimeout, server2.idlePolicy = time.Nanosecond, idleStop
+	do(t, "POST", ts2.URL+"/v1.6/containers/"+id+"/stop", "")
+	if err := server2.reapIfIdle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	server3, ts3 := newTestProxy(cloud)
+	defer ts3.Close()
+	defer server3.closeTunnel()
+	if status, body := do(t, "GET", ts3.URL+"/v1.6/containers/"+id+"/json", ""); status != 200 {
+		t.Errorf("inspect after a stop and a restart: got %d %q", status, body)
+	}
+	if names := cloud.Instances(); len(names) != 1 {
+		t.Errorf("got instances %v after a stop and a restart, want the pool instance alone", names)
+	}
+}
+
+func TestPoolDeletesFailedInstances(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	cloud.Fail = func(op, name string) error {
+		if op == "boot" {
+			return errors.New("docker failed to start")
+		}
+		return nil
+	}
+	pool := newInstancePool(cloud, "docker-instance-pool-", 1, 0, 5*time.Second)
+	if err := pool.fill(context.Background()); err == nil {
+		t.Error("filling the pool went through")
+	}
+	if names := cloud.Instances(); len(names) != 0 {
+		t.Errorf("got instances %v, want the failed one deleted", names)
+	}
+}
+
+func TestPoolReplacesOldInstances(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	pool := newInstancePool(cloud, "docker-instance-pool-", 2, time.Hour, 5*time.Second)
+	ctx := context.Background()
+	if err := pool.fill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	old := cloud.Instances()
+	if len(old) != 2 {
+		t.Fatalf("got instances %v, want 2", old)
+	}
+	pool.mu.Lock()
+	pool.idle[0].created = time.Now().Add(-2 * time.Hour)
+	pool.mu.Unlock()
+	if err := pool.fill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	names := cloud.Instances()
+	if len(names) != 2 {
+		t.Fatalf("got instances %v, want 2", names)
+	}
+	for _, name := range names {
+		if name == old[0] {
+			t.Errorf("instance %q outlived its max age", name)
+		}
+	}
+}
+
+func TestPoolKeepsOldInstanceUntilDeleted(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	pool := newInstancePool(cloud, "docker-instance-pool-", 1, time.Hour, 5*time.Second)
+	ctx := context.Background()
+	if err := pool.fill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	old := cloud.Instances()
+	pool.mu.Lock()
+	pool.idle[0].created = time.Now().Add(-2 * time.Hour)
+	pool.mu.Unlock()
+	cloud.Fail = func(op, name string) error {
+		if op == "delete" {
+			return errors.New("delete failed")
+		}
+		return nil
+	}
+	if err := pool.fill(ctx); err == nil {
+		t.Fatal("fill succeeded, want the delete error")
+	}
+	if instance := pool.take(); instance != nil {
+		t.Errorf("pool handed out %q, which outlived its max age", instance.Name())
+	}
+	if n := pool.len(); n != 0 {
+		t.Errorf("pool has %d instances, want 0", n)
+	}
+	cloud.Fail = nil
+	if err := pool.fill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	names := cloud.Instances()
+	if len(names) != 1 || names[0] == old[0] {
+		t.Errorf("got instances %v, want a single one replacing %v", names, old)
+	}
+}
+
+func TestPoolAdoptsInstancesOfPreviousRun(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	ctx := context.Background()
+	previous := newInstancePool(cloud, "docker-instance-pool-", 3, time.Hour, 5*time.Second)
+	if err := previous.fill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	other := newInstancePool(cloud, "other-instance-pool-", 1, time.Hour, 5*time.Second)
+	if err := other.fill(ctx); err != nil {
+		t.Fatal(err)
+	}
+	otherName := other.take().Name()
+	// One of them went to a slot before the previous proxy died.
+	taken := previous.take()
+	if err := taken.(dockercloud.Labeler).SetLabel(ctx, slotLabel, "docker-instance"); err != nil {
+		t.Fatal(err)
+	}
+
+	pool := newInstancePool(cloud, "docker-instance-pool-", 1, time.Hour, 5*time.Second)
+	if err := pool.adopt(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := pool.len(); n != 1 {
+		t.Fatalf("pool has %d instances, want 1", n)
+	}
+	adopted := pool.take()
+	if adopted.Name() == taken.Name() {
+		t.Errorf("pool adopted %q, which belongs to a slot", adopted.Name())
+	}
+	if names := cloud.Instances(); len(names) != 3 {
+		t.Errorf("got instances %v, want the adopted one, the taken one and the other pool's", names)
+	}
+	for _, name := range []string{adopted.Name(), taken.Name(), otherName} {
+		if _, err := cloud.GetInstance(ctx, name); err != nil {
+			t.Errorf("instance %q: %v", name, err)
+		}
+	}
+}
+
+func TestRouterGivesEachClientItsOwnInstance(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	keyOf, _, err := routeKeyFunc("header:X-Docker-User")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := newRouter(context.Background(), keyOf, 10, func(ctx context.Context, key string) backend {
+		return &ProxyServer{
+			instanceName:  routedInstanceName("docker-instance", key, false),
+			dockerPort:    8000,
+			createTimeout: 5 * time.Second,
+			provider:      cloud,
+		}
+	})
+	ts := httptest.NewServer(rt)
+	defer ts.Close()
+	defer rt.closeTunnel()
+
+	for _, user := range []string{"alice", "bob", "alice"} {
+		req, err := http.NewRequest("POST", ts.URL+"/v1.6/containers/create", strings.NewReader(`{"Image": "busybox"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Docker-User", user)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusCreated {
+			t.Fatalf("create as %s: got %d", user, res.StatusCode)
+		}
+	}
+	names := cloud.Instances()
+	if len(names) != 2 {
+		t.Fatalf("got instances %v, want one per user", names)
+	}
+	for i, user := range []string{"alice", "bob"} {
+		if !strings.HasPrefix(names[i], "docker-instance-"+user+"-") {
+			t.Errorf("got instance %q, want one named after %s", names[i], user)
+		}
+	}
+
+	if status, body := do(t, "GET", ts.URL+"/v1.6/containers/json", ""); status != http.StatusUnauthorized {
+		t.Errorf("anonymous request: got %d %q, want 401", status, body)
+	}
+}
+
+func TestRouterLimitsClients(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	keyOf, _, err := routeKeyFunc("header:X-Docker-User")
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := make(map[string]*ProxyServer)
+	var mu sync.Mutex
+	var stopped []string
+	rt := newRouter(context.Background(), keyOf, 1, func(ctx context.Context, key string) backend {
+		server := &ProxyServer{
+			instanceName:  routedInstanceName("docker-instance", key, false),
+			dockerPort:    8000,
+			createTimeout: 5 * time.Second,
+			idleTimeout:   time.Nanosecond,
+			provider:      cloud,
+		}
+		servers[key] = server
+		go func() {
+			<-ctx.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			stopped = append(stopped, key)
+		}()
+		return server
+	})
+	ts := httptest.NewServer(rt)
+	defer ts.Close()
+	defer rt.closeTunnel()
+
+	info := func(user string) int {
+		req, err := http.NewRequest("GET", ts.URL+"/v1.6/info", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Docker-User", user)
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.StatusCode
+	}
+	if status := info("alice"); status != http.StatusOK {
+		t.Fatalf("info as alice: got %d", status)
+	}
+	if status := info("bob"); status != http.StatusServiceUnavailable {
+		t.Errorf("info as bob while alice has an instance: got %d, want 503", status)
+	}
+
+	// Once alice's instance is reaped, bob takes her place.
+	if err := servers["alice"].reapIfIdle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if status := info("bob"); status != http.StatusOK {
+		t.Errorf("info as bob once alice is idle: got %d", status)
+	}
+	if len(rt.backends) != 1 || rt.backends["bob"] == nil {
+		t.Errorf("got backends %v, want bob's alone", rt.backends)
+	}
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if len(stopped) != 1 || stopped[0] != "alice" {
+		t.Errorf("stopped backends %v, want alice's", stopped)
+	}
+}
+
+func TestRoutedInstanceName(t *testing.T) {
+	for _, test := range []struct {
+		key    string
+		secret bool
+		prefix string
+	}{
+		{"alice", false, "docker-instance-alice-"},
+		{"Alice Smith <alice@example.com>", false, "docker-instance-alice-smith-alice-example-com-"},
+		{"--", false, "docker-instance-"},
+		{strings.Repeat("a", 100), false, "docker-instance-aaaa"},
+		{"s3cret", true, "docker-instance-"},
+	} {
+		name := routedInstanceName("docker-instance", test.key, test.secret)
+		if !strings.HasPrefix(name, test.prefix) || len(name) > maxInstanceNameLen || strings.Contains(name, "--") {
+			t.Errorf("routedInstanceName(%q, %v) = %q, want a name starting with %q", test.key, test.secret, name, test.prefix)
+		}
+		if test.secret && strings.Contains(name, test.key) {
+			t.Errorf("routedInstanceName(%q, true) = %q shows the key", test.key, name)
+		}
+	}
+	if routedInstanceName("docker-instance", "alice", false) == routedInstanceName("docker-instance", "Alice", false) {
+		t.Error("keys that only differ in case got the same instance")
+	}
+}
+
+func newTestFleet(cloud *dockercloud.FakeCloud, maxHosts int) (*fleet, *httptest.Server) {
+	f := newFleet("docker-instance", cloud, maxHosts, 0.5, 256<<20, func(name string) *ProxyServer {
+		return &ProxyServer{
+			instanceName:  name,
+			dockerPort:    8000,
+			createTimeout: 5 * time.Second,
+			provider:      cloud,
+		}
+	})
+	return f, httptest.NewServer(f)
+}
+
+func TestFleetSchedulesOnFreeInstances(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	f, ts := newTestFleet(cloud, 3)
+	defer ts.Close()
+	defer f.closeTunnel()
+
+	// A fake instance has a CPU, which fits two containers.
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id := createContainer(t, ts.URL)
+		if status, body := do(t, "POST", ts.URL+"/v1.6/containers/"+id[:12]+"/start", ""); status != http.StatusNoContent {
+			t.Fatalf("start: got %d %q", status, body)
+		}
+		ids = append(ids, id)
+	}
+	names := cloud.Instances()
+	if len(names) != 2 || names[0] != "docker-instance" || names[1] != "docker-instance-1" {
+		t.Fatalf("got instances %v, want docker-instance and docker-instance-1", names)
+	}
+
+	// Every container is reachable through the fleet, wherever it runs.
+	for _, id := range ids {
+		if status, body := do(t, "GET", ts.URL+"/v1.6/containers/"+id+"/json", ""); status != 200 || !strings.Contains(body, id) {
+			t.Errorf("inspect %s: got %d %q", id, status, body)
+		}
+	}
+	status, body := do(t, "GET", ts.URL+"/v1.6/containers/json", "")
+	if status != 200 || strings.Count(body, `"Id"`) != 3 {
+		t.Errorf("list: got %d %q, want the 3 containers", status, body)
+	}
+	if status, _ := do(t, "DELETE", ts.URL+"/v1.6/containers/"+ids[2], ""); status != http.StatusNoContent {
+		t.Errorf("delete: got %d", status)
+	}
+	if status, _ := do(t, "GET", ts.URL+"/v1.6/containers/nosuchcontainer/json", ""); status != http.StatusNotFound {
+		t.Errorf("inspect of a missing container: got %d, want 404", status)
+	}
+}
+
+func TestFleetFindsContainersItDidNotCreate(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	f, ts := newTestFleet(cloud, 2)
+	defer ts.Close()
+	defer f.closeTunnel()
+	id := createContainer(t, ts.URL)
+
+	// A restarted proxy doesn't know where containers run.
+	f2, ts2 := newTestFleet(cloud, 2)
+	defer ts2.Close()
+	defer f2.closeTunnel()
+	f2.currentHost()
+	if status, body := do(t, "POST", ts2.URL+"/v1.6/containers/"+id[:12]+"/start", ""); status != http.StatusNoContent {
+		t.Errorf("start: got %d %q", status, body)
+	}
+}
+
+func TestFleetFindsInstancesItDidNotCreate(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	f, ts := newTestFleet(cloud, 3)
+	defer ts.Close()
+	defer f.closeTunnel()
+	for i := 0; i < 3; i++ {
+		id := createContainer(t, ts.URL)
+		do(t, "POST", ts.URL+"/v1.6/containers/"+id+"/start", "")
+	}
+	if names := cloud.Instances(); len(names) != 2 {
+		t.Fatalf("got instances %v, want 2", names)
+	}
+
+	// A restarted proxy lists the containers of every instance.
+	f2, ts2 := newTestFleet(cloud, 3)
+	defer ts2.Close()
+	defer f2.closeTunnel()
+	status, body := do(t, "GET", ts2.URL+"/v1.6/containers/json", "")
+	if status != 200 || strings.Count(body, `"Id"`) != 3 {
+		t.Errorf("list after a restart: got %d %q, want the 3 containers", status, body)
+	}
+	// And schedules on them rather than making a third one.
+	createContainer(t, ts2.URL)
+	if names := cloud.Instances(); len(names) != 2 {
+		t.Errorf("got instances %v after a restart, want the 2 there were", names)
+	}
+}
+
+func TestFleetForgetsRemovedContainers(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	f, ts := newTestFleet(cloud, 2)
+	defer ts.Close()
+	defer f.closeTunnel()
+	deleted, removed := createContainer(t, ts.URL), createContainer(t, ts.URL)
+	known := func(id string) bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.containers[id] != nil
+	}
+
+	if status, _ := do(t, "DELETE", ts.URL+"/v1.6/containers/"+deleted[:12], ""); status != http.StatusNoContent {
+		t.Errorf("delete: got %d", status)
+	}
+	if known(deleted) {
+		t.Error("the fleet still knows of a deleted container")
+	}
+
+	// A 404 about something else leaves the container be.
+	if status, _ := do(t, "GET", ts.URL+"/v1.6/containers/"+removed+"/archive?path=/nosuchfile", ""); status != http.StatusNotFound {
+		t.Errorf("archive of a missing file: got %d, want 404", status)
+	}
+	if !known(removed) {
+		t.Error("the fleet forgot a container that is still there")
+	}
+	// One removed behind the fleet's back is forgotten once its host says so.
+	f2, ts2 := newTestFleet(cloud, 2)
+	defer ts2.Close()
+	defer f2.closeTunnel()
+	if status, _ := do(t, "DELETE", ts2.URL+"/v1.6/containers/"+removed, ""); status != http.StatusNoContent {
+		t.Errorf("delete through another proxy: got %d", status)
+	}
+	if status, _ := do(t, "GET", ts.URL+"/v1.6/containers/"+removed+"/json", ""); status != http.StatusNotFound {
+		t.Errorf("inspect of a removed container: got %d, want 404", status)
+	}
+	if known(removed) {
+		t.Error("the fleet still knows of a container its host doesn't have")
+	}
+}
+
+func TestFleetPrunesEveryInstance(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	f, ts := newTestFleet(cloud, 2)
+	defer ts.Close()
+	defer f.closeTunnel()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id := createContainer(t, ts.URL)
+		do(t, "POST", ts.URL+"/v1.6/containers/"+id+"/start", "")
+		ids = append(ids, id)
+	}
+	if names := cloud.Instances(); len(names) != 2 {
+		t.Fatalf("got instances %v, want 2", names)
+	}
+	// One stopped container on each instance.
+	for _, id := range []string{ids[0], ids[2]} {
+		if status, body := do(t, "POST", ts.URL+"/v1.6/containers/"+id+"/stop", ""); status != http.StatusNoContent {
+			t.Fatalf("stop: got %d %q", status, body)
+		}
+	}
+
+	status, body := do(t, "POST", ts.URL+"/containers/prune", "")
+	if status != 200 {
+		t.Fatalf("prune: got %d %q", status, body)
+	}
+	var pruned struct {
+		ContainersDeleted []string
+		SpaceReclaimed    int64
+	}
+	if err := json.Unmarshal([]byte(body), &pruned); err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned.ContainersDeleted) != 2 || pruned.ContainersDeleted[0] != ids[0] || pruned.ContainersDeleted[1] != ids[2] {
+		t.Errorf("prune: got %v deleted, want %s and %s", pruned.ContainersDeleted, ids[0], ids[2])
+	}
+	if status, _ := do(t, "GET", ts.URL+"/v1.6/containers/"+ids[2]+"/json", ""); status != http.StatusNotFound {
+		t.Errorf("inspect of a pruned container: got %d, want 404", status)
+	}
+	if status, _ := do(t, "GET", ts.URL+"/v1.6/containers/"+ids[1]+"/json", ""); status != 200 {
+		t.Errorf("inspect of a running container: got %d, want 200", status)
+	}
+}
+
+func TestFleetFull(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	f, ts := newTestFleet(cloud, 1)
+	defer ts.Close()
+	defer f.closeTunnel()
+	status, body := do(t, "POST", ts.URL+"/v1.6/containers/create", `{"Image": "busybox", "HostConfig": {"Memory": 2147483648}}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create on an empty fleet: got %d %q", status, body)
+	}
+	status, body = do(t, "POST", ts.URL+"/v1.6/containers/create", `{"Image": "busybox"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create next to a stopped container: got %d %q", status, body)
+	}
+	id := body[strings.Index(body, `"Id":"`)+6:]
+	id = id[:strings.Index(id, `"`)]
+	do(t, "POST", ts.URL+"/v1.6/containers/"+id+"/start", "")
+	status, body = do(t, "POST", ts.URL+"/v1.6/containers/create", `{"Image": "busybox", "HostConfig": {"Memory": 1073741824}}`)
+	if status != 500 || !strings.Contains(body, "full") {
+		t.Errorf("create on a full fleet: got %d %q", status, body)
+	}
+}
+
+func TestDoServeRewritesPublishedPorts(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+
+	status, body := do(t, "POST", ts.URL+"/v1.6/containers/create",
+		`{"Image": "nginx", "HostConfig": {"PortBindings": {"80/tcp": [{"HostPort": "8080"}], "443/tcp": [{"HostIp": "127.0.0.1", "HostPort": "8443"}]}}}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create: got %d %q", status, body)
+	}
+	id := body[strings.Index(body, `"Id":"`)+6:]
+	id = id[:strings.Index(id, `"`)]
+	do(t, "POST", ts.URL+"/v1.6/containers/"+id+"/start", "")
+	instance, err := cloud.GetInstance(context.Background(), "docker-instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := instance.IP()
+
+	_, body = do(t, "GET", ts.URL+"/v1.6/containers/json", "")
+	if !strings.Contains(body, `"IP":"`+ip+`"`) || strings.Contains(body, "0.0.0.0") {
+		t.Errorf("list: got %q, want ports published at %s", body, ip)
+	}
+	if !strings.Contains(body, `"IP":"127.0.0.1"`) {
+		t.Errorf("list: got %q, want ports bound to an address left alone", body)
+	}
+	_, body = do(t, "GET", ts.URL+"/v1.6/containers/"+id+"/json", "")
+	if !strings.Contains(body, `"HostIp":"`+ip+`"`) || strings.Contains(body, "0.0.0.0") {
+		t.Errorf("inspect: got %q, want ports published at %s", body, ip)
+	}
+}
+
+// Returns a port nothing listens on locally.
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// Waits for cond to hold, failing the test after a while.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestForwardPorts(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+	server.forwards = newPortForwards(server.dialPort)
+
+	port := freePort(t)
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	takenPort := taken.Addr().(*net.TCPAddr).Port
+	status, body := do(t, "POST", ts.URL+"/v1.6/containers/create", fmt.Sprintf(
+		`{"Image": "nginx", "HostConfig": {"PortBindings": {"80/tcp": [{"HostPort": "%d"}], "443/tcp": [{"HostPort": "%d"}]}}}`, port, takenPort))
+	if status != http.StatusCreated {
+		t.Fatalf("create: got %d %q", status, body)
+	}
+	id := body[strings.Index(body, `"Id":"`)+6:]
+	id = id[:strings.Index(id, `"`)]
+	do(t, "POST", ts.URL+"/v1.6/containers/"+id+"/start", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.watchPorts(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	waitFor(t, "the port to be forwarded", func() bool { return server.forwards.forwarded(port) })
+	// Every port of a fake instance leads to its daemon.
+	res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d/_ping", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(data) != "OK" {
+		t.Errorf("forwarded port: got %q, want the daemon", data)
+	}
+	if server.forwards.forwarded(takenPort) {
+		t.Error("forwarded a port that is taken locally")
+	}
+	_, body = do(t, "GET", ts.URL+"/v1.6/containers/json", "")
+	if !strings.Contains(body, fmt.Sprintf(`"IP":"127.0.0.1","PrivatePort":80,"PublicPort":%d`, port)) {
+		t.Errorf("list: got %q, want the forwarded port on localhost", body)
+	}
+
+	do(t, "POST", ts.URL+"/v1.6/containers/"+id+"/stop", "")
+	waitFor(t, "the forward to be closed", func() bool { return !server.forwards.forwarded(port) })
+}
+
+func TestExposePorts(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+	server.exposePorts = true
+
+	status, body := do(t, "POST", ts.URL+"/v1.6/containers/create",
+		`{"Image": "nginx", "HostConfig": {"PortBindings": {"80/tcp": [{"HostPort": "8080"}], "53/udp": [{"HostPort": "5353"}], "443/tcp": [{"HostIp": "127.0.0.1", "HostPort": "8443"}]}}}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create: got %d %q", status, body)
+	}
+	id := body[strings.Index(body, `"Id":"`)+6:]
+	id = id[:strings.Index(id, `"`)]
+	do(t, "POST", ts.URL+"/v1.6/containers/"+id+"/start", "")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		server.watchPorts(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	want := fmt.Sprint([]dockercloud.Port{{Number: 5353, Protocol: "udp"}, {Number: 8080, Protocol: "tcp"}})
+	waitFor(t, "the ports to be exposed", func() bool {
+		return fmt.Sprint(cloud.PublishedPorts("docker-instance")) == want
+	})
+	do(t, "POST", ts.URL+"/v1.6/containers/"+id+"/stop", "")
+	waitFor(t, "the ports to be closed", func() bool {
+		return len(cloud.PublishedPorts("docker-instance")) == 0
+	})
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-cloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "docker.sock")
+
+	// A socket left behind by a proxy that died is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, addr, err := listen("unix://"+path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if addr != "unix://"+path {
+		t.Errorf("got docker -H %s, want unix://%s", addr, path)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Errorf("socket has mode %v, want 0600", fi.Mode().Perm())
+	}
+	if _, _, err := listen("unix://"+path, 0600, nil); err == nil {
+		t.Error("listening on a socket in use succeeded")
+	}
+
+	cloud := dockercloud.NewFakeCloud()
+	server := &ProxyServer{instanceName: "docker-instance", dockerPort: 8000, provider: cloud}
+	defer server.closeTunnel()
+	go http.Serve(l, server)
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", path)
+		},
+	}}
+	res, err := client.Get("http://docker/v1.6/containers/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != 200 || string(body) != "[]" {
+		t.Errorf("list over the socket: got %d %q", res.StatusCode, body)
+	}
+}
+
+func TestListenTLSVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-cloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := generateCerts(dir, []string{"localhost", "127.0.0.1"}, "alice", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	// The CA is kept when more clients get certificates, and so are the
+	// certificates of the other clients.
+	ca, _ := ioutil.ReadFile(filepath.Join(dir, caCertFile))
+	aliceCert, _ := ioutil.ReadFile(filepath.Join(dir, "alice", clientCertFile))
+	if err := generateCerts(dir, []string{"localhost", "127.0.0.1"}, "bob", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := ioutil.ReadFile(filepath.Join(dir, caCertFile)); !bytes.Equal(ca, again) {
+		t.Error("generating certificates again replaced the CA")
+	}
+	if again, _ := ioutil.ReadFile(filepath.Join(dir, "alice", clientCertFile)); !bytes.Equal(aliceCert, again) {
+		t.Error("generating a certificate for bob replaced alice's")
+	}
+	if err := generateCerts(dir, []string{"localhost", "127.0.0.1"}, "alice", time.Hour); err == nil {
+		t.Error("replaced the certificate of alice")
+	}
+
+	config, err := serverTLSConfig(filepath.Join(dir, caCertFile), filepath.Join(dir, serverCertFile), filepath.Join(dir, serverKeyFile), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, addr, err := listen("127.0.0.1:0", 0600, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !strings.HasSuffix(addr, " --tlsverify") {
+		t.Errorf("got docker flags %q, want --tlsverify", addr)
+	}
+	cloud := dockercloud.NewFakeCloud()
+	rt := newRouter(context.Background(), certKey, 10, func(ctx context.Context, key string) backend {
+		return &ProxyServer{instanceName: routedInstanceName("docker-instance", key, false), dockerPort: 8000, provider: cloud}
+	})
+	defer rt.closeTunnel()
+	go http.Serve(l, rt)
+	url := "https://" + l.Addr().String() + "/v1.6/containers/create"
+
+	// Set up a client the way docker --tlsverify does, from DOCKER_CERT_PATH.
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	if certPathCA, _ := ioutil.ReadFile(filepath.Join(dir, "alice", caCertFile)); !bytes.Equal(ca, certPathCA) {
+		t.Error("the CA is missing from the client directory")
+	}
+	cert, err := tls.LoadX509KeyPair(filepath.Join(dir, "alice", clientCertFile), filepath.Join(dir, "alice", clientKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{cert}}}}
+	res, err := client.Post(url, "application/json", strings.NewReader(`{"Image": "busybox"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Errorf("create: got %d", res.StatusCode)
+	}
+	if names := cloud.Instances(); len(names) != 1 || !strings.HasPrefix(names[0], "docker-instance-alice-") {
+		t.Errorf("got instances %v, want one named after the client certificate", names)
+	}
+
+	anonymous := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}}
+	if res, err := anonymous.Post(url, "application/json", strings.NewReader(`{"Image": "busybox"}`)); err == nil {
+		res.Body.Close()
+		t.Errorf("a client without a certificate got %d", res.StatusCode)
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-cloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "policy.json")
+	if err := ioutil.WriteFile(file, []byte(`{
+		"Endpoints": [
+			{"Method": "GET", "Path": "/containers/json"},
+			{"Method": "POST", "Path": "/containers/create"},
+			{"Path": "/containers/*/start"},
+			{"Method": "POST", "Path": "/volumes/create"},
+			{"Method": "POST", "Path": "/build"}
+		],
+		"AllowedBinds": ["/data/"]
+	}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := loadPolicy(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		method, path, body string
+		allowed            bool
+	}{
+		{"GET", "/v1.6/containers/json", "", true},
+		{"GET", "/containers/json", "", true},
+		{"DELETE", "/v1.6/containers/abc", "", false},
+		{"POST", "/v1.6/images/create", "", false},
+		{"POST", "/v1.6/containers/create", `{"Image": "busybox"}`, true},
+		{"POST", "/v1.6/containers/create", `{"Image": "busybox", "HostConfig": {"Privileged": true}}`, false},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"NetworkMode": "host"}}`, false},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"Binds": ["/data/src:/src", "cache:/cache"]}}`, true},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"Binds": ["/var/run/docker.sock:/var/run/docker.sock"]}}`, false},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"Binds": ["/data/../etc:/etc"]}}`, false},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"Mounts": [{"Type": "bind", "Source": "/"}]}}`, false},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"Mounts": [{"Type": "volume", "Source": "cache"}]}}`, true},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"Mounts": [{"Type": "volume", "Source": "root", "VolumeOptions": {"DriverConfig": {"Name": "local", "Options": {"type": "none", "o": "bind", "device": "/"}}}}]}}`, false},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"CapAdd": ["ALL"]}}`, false},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"Devices": [{"PathOnHost": "/dev/sda", "PathInContainer": "/dev/sda"}]}}`, false},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"Devices": [], "CapAdd": null, "PidMode": ""}}`, true},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"PidMode": "host"}}`, false},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"IpcMode": "host"}}`, false},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"UsernsMode": "host"}}`, false},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"SecurityOpt": ["seccomp=unconfined"]}}`, false},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"SecurityOpt": ["no-new-privileges"]}}`, true},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"NetworkMode": "container:abc"}}`, false},
+		{"POST", "/v1.6/containers/create", `{"HostConfig": {"NetworkMode": "bridge"}}`, true},
+		{"POST", "/v1.6/volumes/create", `{"Name": "cache"}`, true},
+		{"POST", "/v1.6/volumes/create", `{"Name": "root", "DriverOpts": {"type": "none", "o": "bind", "device": "/"}}`, false},
+		{"POST", "/v1.6/volumes/create", `{"Name": "etc", "Driver": "local", "DriverOpts": {"type": "ext4", "device": "/dev/sda1"}}`, false},
+		{"POST", "/v1.6/volumes/create", `{"Name": "src", "DriverOpts": {"o": "bind", "device": "/data/src"}}`, true},
+		{"POST", "/v1.6/volumes/create", `{"Name": "scratch", "DriverOpts": {"type": "tmpfs", "device": "tmpfs"}}`, true},
+		{"POST", "/v1.6/build?t=app", "", true},
+		{"POST", "/v1.6/build?networkmode=host", "", false},
+		// Older clients pass the host config when starting.
+		{"POST", "/v1.6/containers/abc/start", `{"Privileged": true}`, false},
+		{"POST", "/v1.6/containers/abc/start", "", true},
+	} {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		err := p.check(r)
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("%s %s %s: got %v, want allowed=%v", test.method, test.path, test.body, err, test.allowed)
+		}
+		if body, _ := ioutil.ReadAll(r.Body); string(body) != test.body {
+			t.Errorf("%s %s: left body %q, want %q", test.method, test.path, body, test.body)
+		}
+	}
+
+	if err := ioutil.WriteFile(file, []byte(`{"AllowPrivileged": true, "AllowHostNet": true}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadPolicy(file); err == nil {
+		t.Error("loaded a policy with a misspelled field")
+	}
+}
+
+func TestPolicyRefusesSwarmServicesAndPlugins(t *testing.T) {
+	for _, test := range []struct {
+		method, path, body string
+	}{
+		{"POST", "/v1.41/swarm/init", `{"ListenAddr": "0.0.0.0:2377"}`},
+		{"GET", "/v1.41/swarm", ""},
+		{"POST", "/v1.41/services/create", `{"TaskTemplate": {"ContainerSpec": {"Image": "busybox", "Mounts": [{"Type": "bind", "Source": "/"}]}}}`},
+		{"POST", "/v1.41/services/abc/update", `{"TaskTemplate": {"ContainerSpec": {"CapabilityAdd": ["ALL"]}}}`},
+		{"POST", "/v1.41/plugins/pull?remote=evil", `[{"Name": "mount", "Value": ["/"]}]`},
+		{"POST", "/v1.41/plugins/evil/enable", ""},
+	} {
+		r := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if err := (&policy{}).check(r); err == nil {
+			t.Errorf("%s %s: allowed without AllowPrivileged", test.method, test.path)
+		}
+		r = httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		if err := (&policy{AllowPrivileged: true}).check(r); err != nil {
+			t.Errorf("%s %s: got %v with AllowPrivileged", test.method, test.path, err)
+		}
+	}
+	r := httptest.NewRequest("GET", "/v1.41/servicesx", nil)
+	if err := (&policy{}).check(r); err != nil {
+		t.Errorf("GET /servicesx: got %v", err)
+	}
+}
+
+func TestDoServeEnforcesPolicy(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+	server.policy = &policy{}
+
+	status, body := do(t, "POST", ts.URL+"/v1.6/containers/create", `{"Image": "busybox", "HostConfig": {"Privileged": true}}`)
+	if status != http.StatusForbidden {
+		t.Errorf("privileged create: got %d %q", status, body)
+	}
+	var res struct{ Message string }
+	if err := json.Unmarshal([]byte(body), &res); err != nil || !strings.Contains(res.Message, "privileged") {
+		t.Errorf("privileged create: got error %q, %v", body, err)
+	}
+	if names := cloud.Instances(); len(names) != 0 {
+		t.Errorf("got instances %v for a forbidden request", names)
+	}
+	createContainer(t, ts.URL)
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, test := range []struct {
+		apiVersion, minAPIVersion, want string
+	}{
+		{"1.24", "", "1.24"},
+		{"1.41", "1.12", "1.41"},
+		{"1.43", "1.12", maxAPIVersion},
+		{"1.50", "1.44", "1.44"},
+		// Too old to say.
+		{"", "", ""},
+	} {
+		daemon := dockercloud.NewFakeDaemon()
+		daemon.APIVersion, daemon.MinAPIVersion = test.apiVersion, test.minAPIVersion
+		ts := httptest.NewServer(daemon)
+		transport := &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return net.Dial("tcp", ts.Listener.Addr().String())
+			},
+		}
+		got, err := negotiateVersion(context.Background(), transport)
+		if err != nil || got != test.want {
+			t.Errorf("daemon supporting %s to %s: got %q, %v, want %q", test.minAPIVersion, test.apiVersion, got, err, test.want)
+		}
+		transport.CloseIdleConnections()
+		ts.Close()
+	}
+}
+
+func TestModernDaemon(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	cloud.NewDaemon = func() http.Handler {
+		daemon := dockercloud.NewFakeDaemon()
+		daemon.APIVersion, daemon.MinAPIVersion = "1.43", "1.24"
+		return daemon
+	}
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+
+	status, body := do(t, "POST", ts.URL+"/v1.43/containers/create", `{"Image": "busybox"}`)
+	if status != http.StatusCreated {
+		t.Fatalf("create: got %d %q", status, body)
+	}
+	// Client requests go through in the version they ask for, or none.
+	if status, body := do(t, "GET", ts.URL+"/containers/json?all=1", ""); status != 200 || !strings.Contains(body, "busybox") {
+		t.Errorf("unversioned list: got %d %q", status, body)
+	}
+	if status, body := do(t, "GET", ts.URL+"/v1.6/containers/json", ""); status != http.StatusBadRequest || !strings.Contains(body, "too old") {
+		t.Errorf("list in an unsupported version: got %d %q", status, body)
+	}
+
+	// The proxy's own requests use a version the daemon supports.
+	server.idleTimeout = time.Nanosecond
+	if err := server.reapIfIdle(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(cloud.Instances()); n != 0 {
+		t.Errorf("got %d instances once idle, want 0", n)
+	}
+}
+
+func TestFlagValue(t *testing.T) {
+	for _, test := range []struct {
+		args  []string
+		value string
+		ok    bool
+	}{
+		{[]string{"start", "-provider", "local"}, "local", true},
+		{[]string{"start", "--provider=fake", "-port", "80"}, "fake", true},
+		{[]string{"start", "-provider", "-port", "80"}, "", false},
+		{[]string{"start", "--", "-provider", "local"}, "", false},
+		{[]string{"start"}, "", false},
+	} {
+		if value, ok := flagValue(test.args, "provider"); value != test.value || ok != test.ok {
+			t.Errorf("%v: got %q, %v, want %q, %v", test.args, value, ok, test.value, test.ok)
+		}
+	}
+}
+
+func TestDoServeHijacksAttach(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+	id := createContainer(t, ts.URL)
+
+	conn, err := net.Dial("tcp", ts.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req, _ := http.NewRequest("POST", "/v1.24/containers/"+id+"/attach?stream=1&stdin=1&stdout=1", nil)
+	req.Host = "docker"
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("attach: got %d, want 101", res.StatusCode)
+	}
+
+	if _, err := conn.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := reader.ReadString('\n'); line != "hello\n" {
+		t.Fatalf("got %q, %v, want the echo", line, err)
+	}
+	// Closing stdin reaches the container, which is done then, closing
+	// stdout in turn.
+	if _, err := conn.Write([]byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	conn.(*net.TCPConn).CloseWrite()
+	if rest, err := ioutil.ReadAll(reader); err != nil || string(rest) != "bye" {
+		t.Errorf("got %q, %v, want the rest of the echo then EOF", rest, err)
+	}
+}
+
+func TestOpenTunnelDoesNotBlockRequests(t *testing.T) {
+	cloud := dockercloud.NewFakeCloud()
+	server, ts := newTestProxy(cloud)
+	defer ts.Close()
+	defer server.closeTunnel()
+	createContainer(t, ts.URL)
+	server.closeTunnel()
+
+	dialing, release := make(chan struct{}), make(chan struct{})
+	cloud.Fail = func(op, name string) error {
+		if op == "tunnel" {
+			close(dialing)
+			<-release
+		}
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		createContainer(t, ts.URL)
+	}()
+	<-dialing
+	// Other requests get through while the tunnel is being dialed.
+	begun := make(chan struct{})
+	go func() {
+		server.beginRequest()
+		server.endRequest()
+		close(begun)
+	}()
+	select {
+	case <-begun:
+	case <-time.After(5 * time.Second):
+		t.Error("a request waited on the tunnel being dialed")
+	}
+	close(release)
+	<-done
+}
+
+func TestGenerateCertsWithNewCA(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-cloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	hosts := []string{"localhost"}
+	if err := generateCerts(dir, hosts, "alice", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	// Half a CA is not enough to go on with.
+	os.Remove(filepath.Join(dir, caKeyFile))
+	if err := generateCerts(dir, hosts, "bob", time.Hour); err == nil {
+		t.Error("generated a certificate without the CA key")
+	}
+
+	// With a new CA comes a new server certificate.
+	os.Remove(filepath.Join(dir, caCertFile))
+	if err := generateCerts(dir, hosts, "bob", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	ca, _, err := loadKeyPair(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, _, err := loadKeyPair(filepath.Join(dir, serverCertFile), filepath.Join(dir, serverKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("the server certificate is not signed by the new CA: %v", err)
+	}
+}
+
+func TestGenerateCertsForNewHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "docker-cloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := generateCerts(dir, []string{"localhost"}, "alice", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	first, _, err := loadKeyPair(filepath.Join(dir, serverCertFile), filepath.Join(dir, serverKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same hosts keep the server certificate.
+	if err := generateCerts(dir, []string{"localhost"}, "bob", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	server, _, err := loadKeyPair(filepath.Join(dir, serverCertFile), filepath.Join(dir, serverKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.Equal(first) {
+		t.Error("reissued the server certificate for the same hosts")
+	}
+
+	// Other hosts get a new one, from the same CA.
+	hosts := []string{"proxy.example.com", "10.0.0.1"}
+	if err := generateCerts(dir, hosts, "carol", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	server, _, err = loadKeyPair(filepath.Join(dir, serverCertFile), filepath.Join(dir, serverKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range hosts {
+		if err := server.VerifyHostname(host); err != nil {
+			t.Errorf("the server certificate is not valid for %s: %v", host, err)
+		}
+	}
+	ca, _, err := loadKeyPair(filepath.Join(dir, caCertFile), filepath.Join(dir, caKeyFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := server.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("the new server certificate is not signed by the CA: %v", err)
+	}
+}
@@ -15,24 +15,132 @@
 package dockercloud
 
 import (
-	"os"
+	"context"
+	"errors"
+	"net"
 )
 
-// The Cloud interface provides the contract that cloud providers should implement to enable
-// running Docker containers in their cloud.
-// TODO(bburns): Restructure this into Cloud, Instance and Tunnel interfaces
-type Cloud interface {
-	// GetPublicIPAddress returns the stringified address (e.g "1.2.3.4") of the runtime
-	GetPublicIPAddress(name string, zone string) (string, error)
+// ErrNoSuchInstance is returned by Provider.GetInstance when there is no instance by that name.
+var ErrNoSuchInstance = errors.New("no such instance")
 
-	// CreateInstance creates a virtual machine instance given a name and a zone.  Returns the
-	// IP address of the instance.  Waits until Docker is up and functioning on the machine
-	// before returning.
-	CreateInstance(name string, zone string) (string, error)
+// Instance statuses, as reported by Instance.Status.  Providers may report other statuses
+// while an instance is transitioning between these.
+const (
+	StatusRunning   = "RUNNING"
+	StatusStopped   = "STOPPED"
+	StatusSuspended = "SUSPENDED"
+)
+
+// The Provider interface provides the contract that cloud providers should implement to enable
+// running Docker containers in their cloud.  Where instances live (project, zone, region...)
+// is part of the provider's own configuration.  Every method gives up and returns ctx.Err()
+// once ctx is done.
+type Provider interface {
+	// GetInstance returns the instance with the given name, or ErrNoSuchInstance.
+	GetInstance(ctx context.Context, name string) (Instance, error)
+
+	// CreateInstance creates a virtual machine instance given a name.  Waits until Docker is
+	// up and functioning on the machine before returning.
+	CreateInstance(ctx context.Context, name string) (Instance, error)
+}
+
+// An Instance is a handle on a virtual machine running Docker.  It is a snapshot, so the
+// status it reports doesn't change once it is returned; ask the Provider for a fresh one.
+type Instance interface {
+	// Name returns the name of the instance.
+	Name() string
+
+	// Zone returns where the instance runs, in the provider's terms.
+	Zone() string
+
+	// IP returns the stringified public address (e.g "1.2.3.4") of the instance.
+	IP() string
+
+	// Status returns the status of the instance, e.g. StatusRunning.
+	Status() string
+
+	// Labels returns the labels attached to the instance.
+	Labels() map[string]string
+
+	// Delete deletes the instance.
+	Delete(ctx context.Context) error
+
+	// Stop stops the instance, keeping its disks around.
+	Stop(ctx context.Context) error
+
+	// Start starts a stopped instance.  Waits until Docker is up and functioning on the
+	// machine before returning.
+	Start(ctx context.Context) error
+
+	// OpenTunnel opens a secure tunnel (generally SSH) between the local host and the
+	// instance.
+	OpenTunnel(ctx context.Context) (Tunnel, error)
+}
+
+// A Suspender is an Instance that can also be suspended, which keeps its memory around on top
+// of its disks, so that it resumes right where it left off.
+type Suspender interface {
+	Instance
+
+	// Suspend suspends the instance.
+	Suspend(ctx context.Context) error
+
+	// Resume resumes a suspended instance.
+	Resume(ctx context.Context) error
+}
+
+// A Labeler is an Instance whose labels can be changed once it is created.
+type Labeler interface {
+	Instance
+
+	// SetLabel attaches the label key with value to the instance, replacing the value it had.
+	SetLabel(ctx context.Context, key, value string) error
+}
+
+// A Waiter is an Instance that can be waited on when it is found in the middle of a
+// transition, e.g. booting because another process started it.
+type Waiter interface {
+	Instance
+
+	// WaitForDocker waits until Docker is up and functioning on the instance, if it is on its
+	// way to running.  Returns at once if it is on its way to being stopped or suspended.
+	WaitForDocker(ctx context.Context) error
+}
+
+// An InstanceFinder is a Provider that can look instances up by label.
+type InstanceFinder interface {
+	Provider
+
+	// FindInstances returns the instances with the label key set to value.
+	FindInstances(ctx context.Context, key, value string) ([]Instance, error)
+}
+
+// A PortPublisher is an Instance that can open ports to the outside world, so that the ports
+// containers publish are reachable at IP() without going through a tunnel.
+type PortPublisher interface {
+	Instance
+
+	// PublishPorts makes exactly ports reachable from outside, closing the ports it opened
+	// before and that are no longer in ports.  What is allowed to reach them is up to the
+	// provider's configuration.
+	PublishPorts(ctx context.Context, ports []Port) error
+}
+
+// A port on an instance.
+type Port struct {
+	Number int
+	// Protocol is "tcp" or "udp".
+	Protocol string
+}
+
+// A Tunnel carries connections from the local host to ports on an instance.
+type Tunnel interface {
+	// Dial opens a connection to port on the instance through the tunnel.
+	Dial(ctx context.Context, port int) (net.Conn, error)
 
-	// DeleteInstance deletes a virtual machine instance, given the instance name and zone.
-	DeleteInstance(name string, zone string) error
+	// Close closes the tunnel and every connection made through it.
+	Close() error
 
-	// Open a secure tunnel (generally SSH) between the local host and a remote host.
-	OpenSecureTunnel(name string, zone string, localPort int, remotePort int) (*os.Process, error)
+	// Healthy returns false once the tunnel is broken or closed.
+	Healthy() bool
 }
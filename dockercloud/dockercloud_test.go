@@ -0,0 +1,477 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// An in-process SSH server, forwarding direct-tcpip channels like sshd does.
+type testSSHServer struct {
+	listener net.Listener
+	hostKey  ssh.Signer
+	// Whether to answer global requests such as keepalives.
+	answer bool
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func newTestSSHKey(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func startTestSSHServer(t *testing.T, answer bool) *testSSHServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSSHServer{listener: listener, hostKey: newTestSSHKey(t), answer: answer}
+	config := &ssh.ServerConfig{NoClientAuth: true}
+	config.AddHostKey(s.hostKey)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns = append(s.conns, conn)
+			s.mu.Unlock()
+			go s.serve(conn, config)
+		}
+	}()
+	return s
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go func() {
+		for req := range reqs {
+			if s.answer && req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}()
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+			continue
+		}
+		var target struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &target); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		upstream, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(target.Port))))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, chanReqs, err := newChannel.Accept()
+		if err != nil {
+			upstream.Close()
+			continue
+		}
+		go ssh.DiscardRequests(chanReqs)
+		go func() {
+			io.Copy(upstream, channel)
+			upstream.(*net.TCPConn).CloseWrite()
+		}()
+		go func() {
+			io.Copy(channel, upstream)
+			channel.Close()
+			upstream.Close()
+		}()
+	}
+}
+
+// Cuts every connection to the server.
+func (s *testSSHServer) dropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+func (s *testSSHServer) Close() {
+	s.listener.Close()
+	s.dropConnections()
+}
+
+func (s *testSSHServer) dial(t *testing.T) *SSHTunnel {
+	config := &ssh.ClientConfig{
+		User:            "docker",
+		HostKeyCallback: ssh.FixedHostKey(s.hostKey.PublicKey()),
+	}
+	tunnel, err := newSSHTunnel(context.Background(), s.listener.Addr().String(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tunnel
+}
+
+// Serves TCP on a local port, echoing back what it reads.
+func startEchoServer(t *testing.T) (net.Listener, int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return listener, listener.Addr().(*net.TCPAddr).Port
+}
+
+// Waits up to a few seconds for the tunnel to break.
+func waitBroken(tunnel *SSHTunnel) bool {
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if !tunnel.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSSHTunnelDial(t *testing.T) {
+	server := startTestSSHServer(t, true)
+	defer server.Close()
+	echo, port := startEchoServer(t)
+	defer echo.Close()
+	tunnel := server.dial(t)
+	defer tunnel.Close()
+
+	conn, err := tunnel.Dial(context.Background(), port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hello" {
+		t.Errorf("got %q, %v through the tunnel, want hello", buf, err)
+	}
+	if !tunnel.Healthy() {
+		t.Errorf("tunnel broken: %v", tunnel.Err())
+	}
+
+	tunnel.Close()
+	if tunnel.Healthy() {
+		t.Error("tunnel healthy once closed")
+	}
+	if _, err := tunnel.Dial(context.Background(), port); err != errTunnelClosed {
+		t.Errorf("dial once closed: got %v, want %v", err, errTunnelClosed)
+	}
+	// Closing the tunnel closes the connections made through it.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(buf); err == nil {
+		t.Error("connection still open once the tunnel is closed")
+	}
+}
+
+func TestSSHTunnelBreaksWithConnection(t *testing.T) {
+	server := startTestSSHServer(t, true)
+	defer server.Close()
+	tunnel := server.dial(t)
+	defer tunnel.Close()
+
+	server.dropConnections()
+	if !waitBroken(tunnel) {
+		t.Fatal("tunnel still healthy once the connection dropped")
+	}
+	if tunnel.Err() == errTunnelClosed {
+		t.Errorf("got %v, want the connection error", tunnel.Err())
+	}
+}
+
+func TestSSHTunnelKeepalive(t *testing.T) {
+	defer func(interval, timeout time.Duration) {
+		sshKeepaliveInterval, sshKeepaliveTimeout = interval, timeout
+	}(sshKeepaliveInterval, sshKeepaliveTimeout)
+	sshKeepaliveInterval, sshKeepaliveTimeout = 10*time.Millisecond, 100*time.Millisecond
+
+	// A server that answers keeps the tunnel up.
+	server := startTestSSHServer(t, true)
+	defer server.Close()
+	tunnel := server.dial(t)
+	defer tunnel.Close()
+	time.Sleep(5 * sshKeepaliveTimeout)
+	if !tunnel.Healthy() {
+		t.Errorf("tunnel broken with the server answering keepalives: %v", tunnel.Err())
+	}
+
+	// One that stops answering, like behind a dead NAT mapping, breaks it.
+	silent := startTestSSHServer(t, false)
+	defer silent.Close()
+	tunnel = silent.dial(t)
+	defer tunnel.Close()
+	if !waitBroken(tunnel) {
+		t.Fatal("tunnel still healthy without keepalive answers")
+	}
+	if err := tunnel.Err(); err == nil || !strings.Contains(err.Error(), "keepalive") {
+		t.Errorf("got %v, want a keepalive error", err)
+	}
+}
+
+func newTestKnownHosts(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "docker-cloud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "known_hosts"), func() { os.RemoveAll(dir) }
+}
+
+// The keys a host publishes.
+func published(keys ...ssh.PublicKey) func() ([]ssh.PublicKey, error) {
+	return func() ([]ssh.PublicKey, error) {
+		return keys, nil
+	}
+}
+
+func checkHostKey(t *testing.T, khPath, host string, key ssh.PublicKey, trusted func() ([]ssh.PublicKey, error)) error {
+	check, err := pinnedHostKeyCallback(khPath, host, trusted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return check(host+":22", &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 22}, key)
+}
+
+func TestPinnedHostKeyFirstSeen(t *testing.T) {
+	khPath, cleanup := newTestKnownHosts(t)
+	defer cleanup()
+	host := "docker-instance.c.project.internal"
+	key, other := newTestSSHKey(t).PublicKey(), newTestSSHKey(t).PublicKey()
+
+	if err := checkHostKey(t, khPath, host, key, published(other)); err == nil {
+		t.Error("accepted a key that wasn't published")
+	}
+	if err := checkHostKey(t, khPath, host, key, published()); err == nil {
+		t.Error("accepted a key with none published")
+	}
+	if data, _ := ioutil.ReadFile(khPath); len(data) != 0 {
+		t.Errorf("pinned a key that wasn't published: %q", data)
+	}
+
+	if err := checkHostKey(t, khPath, host, key, published(other, key)); err != nil {
+		t.Fatalf("refused a published key: %v", err)
+	}
+	// Once pinned, the key is accepted without looking at what is published.
+	unreachable := func() ([]ssh.PublicKey, error) {
+		return nil, errors.New("looked the published keys up")
+	}
+	if err := checkHostKey(t, khPath, host, key, unreachable); err != nil {
+		t.Errorf("refused the pinned key: %v", err)
+	}
+}
+
+func TestPinnedHostKeyMismatch(t *testing.T) {
+	khPath, cleanup := newTestKnownHosts(t)
+	defer cleanup()
+	host := "docker-instance.c.project.internal"
+	key, other := newTestSSHKey(t).PublicKey(), newTestSSHKey(t).PublicKey()
+	if err := checkHostKey(t, khPath, host, key, published(key)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Even published, another key is refused until the pinned one is
+	// forgotten.
+	err := checkHostKey(t, khPath, host, other, published(other))
+	if err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Errorf("got %v for another key, want a mismatch", err)
+	}
+	if err := forgetKnownHost(khPath, host); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkHostKey(t, khPath, host, other, published(other)); err != nil {
+		t.Errorf("refused the published key of a forgotten host: %v", err)
+	}
+}
+
+func TestForgetKnownHost(t *testing.T) {
+	khPath, cleanup := newTestKnownHosts(t)
+	defer cleanup()
+	hosts := []string{
+		"docker-instance.c.project.internal",
+		"docker-instance-1.c.project.internal",
+		"docker-instance.c.project.internal.example.com",
+	}
+	keys := make(map[string]ssh.PublicKey)
+	for _, host := range hosts {
+		keys[host] = newTestSSHKey(t).PublicKey()
+		if err := checkHostKey(t, khPath, host, keys[host], published(keys[host])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := forgetKnownHost(khPath, hosts[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(khPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, hosts[0]+" ") {
+			t.Errorf("%s is still known: %q", hosts[0], line)
+		}
+	}
+	// The others are still pinned.
+	for _, host := range hosts[1:] {
+		if err := checkHostKey(t, khPath, host, newTestSSHKey(t).PublicKey(), published()); err == nil || !strings.Contains(err.Error(), "mismatch") {
+			t.Errorf("%s: got %v for another key, want a mismatch", host, err)
+		}
+		if err := checkHostKey(t, khPath, host, keys[host], published()); err != nil {
+			t.Errorf("%s: refused the pinned key: %v", host, err)
+		}
+	}
+
+	// Forgetting a host of an empty store is fine.
+	os.Remove(khPath)
+	if err := forgetKnownHost(khPath, hosts[0]); err != nil {
+		t.Errorf("forgetting with no store: %v", err)
+	}
+}
+
+func TestGCEFirewallName(t *testing.T) {
+	if rule := gceFirewallName("docker-instance"); rule != "docker-cloud-docker-instance" {
+		t.Errorf("got %q for a short name, want docker-cloud-docker-instance", rule)
+	}
+	valid := regexp.MustCompile(`^[a-z]([-a-z0-9]*[a-z0-9])?$`)
+	prefix := "docker-instance-" + strings.Repeat("x", 50)
+	seen := make(map[string]string)
+	for _, name := range []string{prefix, prefix + "-1", prefix + "-2", strings.Repeat("a", gceMaxNameLen)} {
+		rule := gceFirewallName(name)
+		if len(rule) > gceMaxNameLen || !valid.MatchString(rule) {
+			t.Errorf("%s: got %q, not a valid GCE name", name, rule)
+		}
+		if other, ok := seen[rule]; ok {
+			t.Errorf("%s and %s both got %q", name, other, rule)
+		}
+		seen[rule] = name
+		if again := gceFirewallName(name); again != rule {
+			t.Errorf("%s: got %q, then %q", name, rule, again)
+		}
+	}
+}
+
+// Checks that closing tunnel closes conn, made through it.
+func checkClosesConnections(t *testing.T, tunnel Tunnel, conn net.Conn) {
+	tunnel.Close()
+	if tunnel.Healthy() {
+		t.Error("tunnel healthy once closed")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("got %v reading from a connection of a closed tunnel, want it closed", err)
+	}
+}
+
+func TestFakeTunnelClose(t *testing.T) {
+	cloud := NewFakeCloud()
+	ctx := context.Background()
+	instance, err := cloud.CreateInstance(ctx, "docker-instance")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel, err := instance.OpenTunnel(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := tunnel.Dial(ctx, 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	checkClosesConnections(t, tunnel, conn)
+}
+
+func TestLocalTunnel(t *testing.T) {
+	echo, port := startEchoServer(t)
+	addr := echo.Addr().String()
+	tunnel := &localTunnel{ip: "127.0.0.1", ports: map[int]string{localDockerPort: addr}}
+	ctx := context.Background()
+	conn, err := tunnel.Dial(ctx, localDockerPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Unpublished ports are reached on the container address.
+	other, err := tunnel.Dial(ctx, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.Close()
+	if !tunnel.Healthy() {
+		t.Error("tunnel broken")
+	}
+	checkClosesConnections(t, tunnel, conn)
+
+	// The tunnel breaks once the docker port can't be reached, like when
+	// the container goes away.
+	tunnel = &localTunnel{ip: "127.0.0.1", ports: map[int]string{localDockerPort: addr}}
+	echo.Close()
+	if _, err := tunnel.Dial(ctx, localDockerPort); err == nil {
+		t.Fatal("dialed a closed port")
+	}
+	if tunnel.Healthy() {
+		t.Error("tunnel healthy once the docker port went away")
+	}
+}
@@ -0,0 +1,749 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	RegisterProvider("fake", &fakeFactory{})
+}
+
+// Makes FakeCloud providers from the command line.
+type fakeFactory struct {
+	latency *time.Duration
+}
+
+// Implementation of the ProviderFactory interface
+func (f *fakeFactory) Flags(fs *flag.FlagSet) {
+	f.latency = fs.Duration("latency", 0, "How long creating, deleting, stopping and starting an instance take.")
+}
+
+// Implementation of the ProviderFactory interface
+func (f *fakeFactory) New() (Provider, error) {
+	cloud := NewFakeCloud()
+	cloud.Latency = *f.latency
+	return cloud, nil
+}
+
+// FakeCloud is an in-memory implementation of the Provider interface, for tests and offline
+// development.  Each of its instances runs a fake Docker daemon on a local port, which is
+// where their tunnels lead.
+type FakeCloud struct {
+	// Latency is how long creating, deleting, stopping and starting an instance take.
+	Latency time.Duration
+
+	// Fail, if set, is called before each operation with the operation name ("get",
+	// "create", "delete", "stop", "start", "suspend", "resume", "label", "find", "publish",
+	// "tunnel" or "wait") and the instance name, or the label value for "find".  A non-nil error
+	// fails the operation.  It is also called with "boot" once an instance is created,
+	// failing the creation but leaving the instance behind, like an instance that didn't
+	// come up does.
+	Fail func(op, name string) error
+
+	// NewDaemon returns the handler serving the Docker API of a new instance.  Defaults to
+	// NewFakeDaemon.
+	NewDaemon func() http.Handler
+
+	mu        sync.Mutex
+	instances map[string]*fakeInstance
+	nextIP    int
+}
+
+// The state of an instance, shared by all the handles on it.
+type fakeInstance struct {
+	name   string
+	ip     string
+	status string
+	labels map[string]string
+	daemon http.Handler
+	server *httptest.Server
+	// The ports opened to the outside world.
+	published []Port
+}
+
+// Takes the daemon of the instance down, cutting the connections to it like a
+// VM going away does.
+func (inst *fakeInstance) shutdown() {
+	inst.server.CloseClientConnections()
+	inst.server.Close()
+}
+
+// A snapshot of a fakeInstance, as handed out by FakeCloud.
+type fakeInstanceHandle struct {
+	cloud  *FakeCloud
+	name   string
+	ip     string
+	status string
+	labels map[string]string
+}
+
+// Create a fake cloud with no instances.
+func NewFakeCloud() *FakeCloud {
+	return &FakeCloud{
+		NewDaemon: func() http.Handler { return NewFakeDaemon() },
+		instances: make(map[string]*fakeInstance),
+	}
+}
+
+// Simulates the latency of op, then lets Fail decide whether it goes through.
+func (cloud *FakeCloud) do(ctx context.Context, op, name string, latency time.Duration) error {
+	if latency > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(latency):
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if cloud.Fail != nil {
+		return cloud.Fail(op, name)
+	}
+	return nil
+}
+
+func (cloud *FakeCloud) handle(inst *fakeInstance) *fakeInstanceHandle {
+	labels := make(map[string]string)
+	for k, v := range inst.labels {
+		labels[k] = v
+	}
+	return &fakeInstanceHandle{cloud, inst.name, inst.ip, inst.status, labels}
+}
+
+// Returns the live state of the instance called name, with cloud.mu held.
+func (cloud *FakeCloud) lookup(name string) (*fakeInstance, error) {
+	inst, ok := cloud.instances[name]
+	if !ok {
+		return nil, ErrNoSuchInstance
+	}
+	return inst, nil
+}
+
+// Implementation of the Provider interface
+func (cloud *FakeCloud) GetInstance(ctx context.Context, name string) (Instance, error) {
+	if err := cloud.do(ctx, "get", name, 0); err != nil {
+		return nil, err
+	}
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	inst, err := cloud.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return cloud.handle(inst), nil
+}
+
+// Implementation of the Provider interface
+func (cloud *FakeCloud) CreateInstance(ctx context.Context, name string) (Instance, error) {
+	if err := cloud.do(ctx, "create", name, cloud.Latency); err != nil {
+		return nil, err
+	}
+	cloud.mu.Lock()
+	if _, ok := cloud.instances[name]; ok {
+		cloud.mu.Unlock()
+		return nil, fmt.Errorf("instance %q already exists", name)
+	}
+	cloud.nextIP++
+	daemon := cloud.NewDaemon()
+	inst := &fakeInstance{
+		name:   name,
+		ip:     fmt.Sprintf("10.0.0.%d", cloud.nextIP),
+		status: StatusRunning,
+		labels: make(map[string]string),
+		daemon: daemon,
+		server: httptest.NewServer(daemon),
+	}
+	cloud.instances[name] = inst
+	handle := cloud.handle(inst)
+	cloud.mu.Unlock()
+	if cloud.Fail != nil {
+		if err := cloud.Fail("boot", name); err != nil {
+			return nil, err
+		}
+	}
+	return handle, nil
+}
+
+// Implementation of the InstanceFinder interface
+func (cloud *FakeCloud) FindInstances(ctx context.Context, key, value string) ([]Instance, error) {
+	if err := cloud.do(ctx, "find", value, 0); err != nil {
+		return nil, err
+	}
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	var found []Instance
+	for _, name := range cloud.sortedNames() {
+		if inst := cloud.instances[name]; inst.labels[key] == value {
+			found = append(found, cloud.handle(inst))
+		}
+	}
+	return found, nil
+}
+
+// Instances returns the names of the instances in the cloud, sorted.
+func (cloud *FakeCloud) Instances() []string {
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	return cloud.sortedNames()
+}
+
+// Returns the names of the instances, sorted, with cloud.mu held.
+func (cloud *FakeCloud) sortedNames() []string {
+	var names []string
+	for name := range cloud.instances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Implementation of the Instance interface
+func (h *fakeInstanceHandle) Name() string {
+	return h.name
+}
+
+// Implementation of the Instance interface
+func (h *fakeInstanceHandle) Zone() string {
+	return "fake"
+}
+
+// Implementation of the Instance interface
+func (h *fakeInstanceHandle) IP() string {
+	return h.ip
+}
+
+// Implementation of the Instance interface
+func (h *fakeInstanceHandle) Status() string {
+	return h.status
+}
+
+// Implementation of the Instance interface
+func (h *fakeInstanceHandle) Labels() map[string]string {
+	return h.labels
+}
+
+// Implementation of the Labeler interface
+func (h *fakeInstanceHandle) SetLabel(ctx context.Context, key, value string) error {
+	cloud := h.cloud
+	if err := cloud.do(ctx, "label", h.name, 0); err != nil {
+		return err
+	}
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	inst, err := cloud.lookup(h.name)
+	if err != nil {
+		return err
+	}
+	inst.labels[key] = value
+	return nil
+}
+
+// Implementation of the Instance interface
+func (h *fakeInstanceHandle) Delete(ctx context.Context) error {
+	cloud := h.cloud
+	if err := cloud.do(ctx, "delete", h.name, cloud.Latency); err != nil {
+		return err
+	}
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	inst, err := cloud.lookup(h.name)
+	if err != nil {
+		return err
+	}
+	if inst.server != nil {
+		inst.shutdown()
+	}
+	delete(cloud.instances, h.name)
+	return nil
+}
+
+// Implementation of the Instance interface
+func (h *fakeInstanceHandle) Stop(ctx context.Context) error {
+	return h.cloud.setRunning(ctx, "stop", h.name, StatusStopped)
+}
+
+// Implementation of the Instance interface
+func (h *fakeInstanceHandle) Start(ctx context.Context) error {
+	return h.cloud.setRunning(ctx, "start", h.name, StatusRunning)
+}
+
+// Implementation of the Suspender interface
+func (h *fakeInstanceHandle) Suspend(ctx context.Context) error {
+	return h.cloud.setRunning(ctx, "suspend", h.name, StatusSuspended)
+}
+
+// Implementation of the Suspender interface
+func (h *fakeInstanceHandle) Resume(ctx context.Context) error {
+	return h.cloud.setRunning(ctx, "resume", h.name, StatusRunning)
+}
+
+// Implementation of the Waiter interface.  The daemon of a fake instance is up as soon as it
+// is running, so only Fail has a say.
+func (h *fakeInstanceHandle) WaitForDocker(ctx context.Context) error {
+	return h.cloud.do(ctx, "wait", h.name, 0)
+}
+
+// Implementation of the PortPublisher interface
+func (h *fakeInstanceHandle) PublishPorts(ctx context.Context, ports []Port) error {
+	cloud := h.cloud
+	if err := cloud.do(ctx, "publish", h.name, 0); err != nil {
+		return err
+	}
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	inst, err := cloud.lookup(h.name)
+	if err != nil {
+		return err
+	}
+	inst.published = append([]Port(nil), ports...)
+	return nil
+}
+
+// PublishedPorts returns the ports the instance called name opened to the outside world.
+func (cloud *FakeCloud) PublishedPorts(name string) []Port {
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	if inst, ok := cloud.instances[name]; ok {
+		return append([]Port(nil), inst.published...)
+	}
+	return nil
+}
+
+// Moves the instance called name to status through op.
+func (cloud *FakeCloud) setRunning(ctx context.Context, op, name, status string) error {
+	if err := cloud.do(ctx, op, name, cloud.Latency); err != nil {
+		return err
+	}
+	return cloud.SetStatus(name, status)
+}
+
+// SetStatus moves the instance called name to status, as if something other than the proxy
+// did, e.g. to a transitional status such as "STAGING".  Its daemon is up while the status is
+// StatusRunning, and keeps its state across, like a VM keeps its disk.
+func (cloud *FakeCloud) SetStatus(name, status string) error {
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	inst, err := cloud.lookup(name)
+	if err != nil {
+		return err
+	}
+	if status == StatusRunning && inst.server == nil {
+		inst.server = httptest.NewServer(inst.daemon)
+	}
+	if status != StatusRunning && inst.server != nil {
+		inst.shutdown()
+		inst.server = nil
+	}
+	inst.status = status
+	return nil
+}
+
+// Implementation of the Instance interface
+func (h *fakeInstanceHandle) OpenTunnel(ctx context.Context) (Tunnel, error) {
+	cloud := h.cloud
+	if err := cloud.do(ctx, "tunnel", h.name, 0); err != nil {
+		return nil, err
+	}
+	cloud.mu.Lock()
+	defer cloud.mu.Unlock()
+	inst, err := cloud.lookup(h.name)
+	if err != nil {
+		return nil, err
+	}
+	if inst.server == nil {
+		return nil, fmt.Errorf("instance %q is not running", h.name)
+	}
+	return &fakeTunnel{cloud: cloud, inst: inst, server: inst.server}, nil
+}
+
+// A tunnel to the daemon of a fake instance.  Every port leads to the daemon.
+type fakeTunnel struct {
+	cloud  *FakeCloud
+	inst   *fakeInstance
+	server *httptest.Server
+	conns  tunnelConns
+}
+
+// Implementation of the Tunnel interface
+func (t *fakeTunnel) Dial(ctx context.Context, port int) (net.Conn, error) {
+	if !t.Healthy() {
+		return nil, errors.New("tunnel is broken")
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", t.server.Listener.Addr().String())
+	if err != nil {
+		return nil, err
+	}
+	return t.conns.add(conn)
+}
+
+// Implementation of the Tunnel interface
+func (t *fakeTunnel) Close() error {
+	t.conns.close()
+	return nil
+}
+
+// Implementation of the Tunnel interface
+func (t *fakeTunnel) Healthy() bool {
+	if t.conns.isClosed() {
+		return false
+	}
+	// Like an SSH connection, the tunnel breaks when its instance goes away.
+	t.cloud.mu.Lock()
+	defer t.cloud.mu.Unlock()
+	return t.cloud.instances[t.inst.name] == t.inst && t.inst.server == t.server
+}
+
+// FakeDaemon is an in-memory stand-in for the Docker remote API.  It keeps track of
+// containers being created, started, stopped and removed, which is enough for the proxy to
+// work against.  Attaching to a container echoes what is written to it back, until the
+// client closes its writing side, as if the container ran cat.
+type FakeDaemon struct {
+	// NCPU and MemTotal are the CPUs and bytes of memory the daemon reports in /info.
+	NCPU     int
+	MemTotal int64
+
+	// APIVersion is the newest API version the daemon reports in /version, and
+	// MinAPIVersion the oldest, if any. Requests for versions outside of them fail, like
+	// with real daemons.
+	APIVersion    string
+	MinAPIVersion string
+
+	mu         sync.Mutex
+	containers map[string]*FakeContainer
+	order      []string
+	// The /events streams in progress.
+	watchers map[chan fakeEvent]bool
+}
+
+// An event of a FakeDaemon, in the format of /events.
+type fakeEvent struct {
+	Status string `json:"status"`
+	Id     string `json:"id"`
+	Type   string
+	Action string
+}
+
+// Container ids are unique across daemons, like real ones.
+var fakeNextId int64
+
+// A container of a FakeDaemon.
+type FakeContainer struct {
+	Id      string
+	Image   string
+	Running bool
+	// PortBindings maps the ports of the container, like "80/tcp", to where they are
+	// published, while it runs.
+	PortBindings map[string][]FakePortBinding
+}
+
+// Where a FakeContainer publishes a port.
+type FakePortBinding struct {
+	HostIp   string
+	HostPort string
+}
+
+// Returns the published ports of c, as listed by /containers/json.
+func (c *FakeContainer) ports() []map[string]interface{} {
+	list := []map[string]interface{}{}
+	if !c.Running {
+		return list
+	}
+	for port, bindings := range c.PortBindings {
+		private, proto := port, "tcp"
+		if i := strings.Index(port, "/"); i >= 0 {
+			private, proto = port[:i], port[i+1:]
+		}
+		for _, b := range bindings {
+			privatePort, _ := strconv.Atoi(private)
+			publicPort, _ := strconv.Atoi(b.HostPort)
+			list = append(list, map[string]interface{}{
+				"IP":          b.HostIp,
+				"PrivatePort": privatePort,
+				"PublicPort":  publicPort,
+				"Type":        proto,
+			})
+		}
+	}
+	return list
+}
+
+// Create a fake Docker daemon with no containers.
+func NewFakeDaemon() *FakeDaemon {
+	return &FakeDaemon{
+		NCPU:       1,
+		MemTotal:   1 << 30,
+		APIVersion: "1.24",
+		containers: make(map[string]*FakeContainer),
+	}
+}
+
+var (
+	fakeVersionPrefix = regexp.MustCompile(`^/v([0-9.]+)`)
+	fakeContainerPath = regexp.MustCompile(`^/containers/([^/]+)(/[a-z]+)?$`)
+)
+
+func (d *FakeDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m := fakeVersionPrefix.FindStringSubmatch(r.URL.Path); m != nil {
+		if fakeVersionBefore(m[1], d.MinAPIVersion) {
+			writeFakeJSON(w, http.StatusBadRequest, map[string]string{"message": fmt.Sprintf(
+				"client version %s is too old. Minimum supported API version is %s", m[1], d.MinAPIVersion)})
+			return
+		}
+		if fakeVersionBefore(d.APIVersion, m[1]) {
+			writeFakeJSON(w, http.StatusBadRequest, map[string]string{"message": fmt.Sprintf(
+				"client version %s is too new. Maximum supported API version is %s", m[1], d.APIVersion)})
+			return
+		}
+	}
+	path := fakeVersionPrefix.ReplaceAllString(r.URL.Path, "")
+	if path == "/events" {
+		d.serveEvents(w, r)
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch {
+	case path == "/_ping":
+		fmt.Fprint(w, "OK")
+	case path == "/version":
+		version := map[string]string{"Version": "fake", "ApiVersion": d.APIVersion}
+		if d.MinAPIVersion != "" {
+			version["MinAPIVersion"] = d.MinAPIVersion
+		}
+		writeFakeJSON(w, http.StatusOK, version)
+	case path == "/info":
+		running := 0
+		for _, c := range d.containers {
+			if c.Running {
+				running++
+			}
+		}
+		writeFakeJSON(w, http.StatusOK, map[string]interface{}{
+			"Containers": len(d.containers),
+			"Running":    running,
+			"NCPU":       d.NCPU,
+			"MemTotal":   d.MemTotal,
+		})
+	case path == "/containers/json" && r.Method == "GET":
+		all := r.URL.Query().Get("all") == "1" || r.URL.Query().Get("all") == "true"
+		list := []map[string]interface{}{}
+		for _, id := range d.order {
+			c := d.containers[id]
+			if !c.Running && !all {
+				continue
+			}
+			list = append(list, map[string]interface{}{"Id": c.Id, "Image": c.Image, "Ports": c.ports()})
+		}
+		writeFakeJSON(w, http.StatusOK, list)
+	case path == "/containers/create" && r.Method == "POST":
+		var config struct {
+			Image      string
+			HostConfig struct {
+				PortBindings map[string][]FakePortBinding
+			}
+		}
+		json.NewDecoder(r.Body).Decode(&config)
+		sum := sha256.Sum256([]byte(fmt.Sprint(atomic.AddInt64(&fakeNextId, 1))))
+		c := &FakeContainer{Id: hex.EncodeToString(sum[:]), Image: config.Image, PortBindings: config.HostConfig.PortBindings}
+		for _, bindings := range c.PortBindings {
+			for i := range bindings {
+				if bindings[i].HostIp == "" {
+					bindings[i].HostIp = "0.0.0.0"
+				}
+			}
+		}
+		d.containers[c.Id] = c
+		d.order = append(d.order, c.Id)
+		writeFakeJSON(w, http.StatusCreated, map[string]string{"Id": c.Id})
+	case path == "/containers/prune" && r.Method == "POST":
+		deleted := []string{}
+		for _, id := range append([]string(nil), d.order...) {
+			if !d.containers[id].Running {
+				d.remove(id)
+				deleted = append(deleted, id)
+			}
+		}
+		writeFakeJSON(w, http.StatusOK, map[string]interface{}{"ContainersDeleted": deleted, "SpaceReclaimed": 0})
+	case fakeContainerPath.MatchString(path):
+		m := fakeContainerPath.FindStringSubmatch(path)
+		c := d.find(m[1])
+		if c == nil {
+			writeFakeJSON(w, http.StatusNotFound, map[string]string{"message": "No such container: " + m[1]})
+			return
+		}
+		switch {
+		case m[2] == "/start" && r.Method == "POST":
+			c.Running = true
+			d.publish(c.Id, "start")
+			w.WriteHeader(http.StatusNoContent)
+		case (m[2] == "/stop" || m[2] == "/kill") && r.Method == "POST":
+			c.Running = false
+			d.publish(c.Id, "die")
+			w.WriteHeader(http.StatusNoContent)
+		case m[2] == "/attach" && r.Method == "POST":
+			conn, brw, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			brw.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\n" +
+				"Connection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+			brw.Flush()
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, brw.Reader)
+			}()
+		case m[2] == "/json" && r.Method == "GET":
+			var ports map[string][]FakePortBinding
+			if c.Running {
+				ports = c.PortBindings
+			}
+			writeFakeJSON(w, http.StatusOK, map[string]interface{}{
+				"Id":              c.Id,
+				"Image":           c.Image,
+				"State":           map[string]bool{"Running": c.Running},
+				"NetworkSettings": map[string]interface{}{"Ports": ports},
+			})
+		case m[2] == "" && r.Method == "DELETE":
+			d.remove(c.Id)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.NotFound(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Streams the events of the daemon until the client goes away.
+func (d *FakeDaemon) serveEvents(w http.ResponseWriter, r *http.Request) {
+	events := make(chan fakeEvent, 16)
+	d.mu.Lock()
+	if d.watchers == nil {
+		d.watchers = make(map[chan fakeEvent]bool)
+	}
+	d.watchers[events] = true
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		delete(d.watchers, events)
+		d.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.(http.Flusher).Flush()
+	encoder := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event := <-events:
+			if encoder.Encode(event) != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	}
+}
+
+// Whether API version a is older than b, false if either is empty.
+func fakeVersionBefore(a, b string) bool {
+	if a == "" || b == "" {
+		return false
+	}
+	var va, vb [2]int
+	fmt.Sscanf(a, "%d.%d", &va[0], &va[1])
+	fmt.Sscanf(b, "%d.%d", &vb[0], &vb[1])
+	return va[0] < vb[0] || va[0] == vb[0] && va[1] < vb[1]
+}
+
+// Sends an event about container id to the /events streams, with d.mu held.
+// Slow streams miss events.
+func (d *FakeDaemon) publish(id, action string) {
+	event := fakeEvent{Status: action, Id: id, Type: "container", Action: action}
+	for events := range d.watchers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// Removes the container with id, with d.mu held.
+func (d *FakeDaemon) remove(id string) {
+	delete(d.containers, id)
+	for i, other := range d.order {
+		if other == id {
+			d.order = append(d.order[:i], d.order[i+1:]...)
+			break
+		}
+	}
+	d.publish(id, "destroy")
+}
+
+// Finds a container by id or unique id prefix, with d.mu held.
+func (d *FakeDaemon) find(id string) *FakeContainer {
+	if c, ok := d.containers[id]; ok {
+		return c
+	}
+	var found *FakeContainer
+	for full, c := range d.containers {
+		if strings.HasPrefix(full, id) {
+			if found != nil {
+				return nil
+			}
+			found = c
+		}
+	}
+	return found
+}
+
+// Containers returns a copy of the containers of the daemon, in creation order.
+func (d *FakeDaemon) Containers() []FakeContainer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var list []FakeContainer
+	for _, id := range d.order {
+		list = append(list, *d.containers[id])
+	}
+	return list
+}
+
+func writeFakeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -15,22 +15,26 @@
 package dockercloud
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/user"
 	"path"
 	"strings"
+	"sync"
 	"time"
 
-	"code.google.com/p/goauth2/oauth"
-	compute "code.google.com/p/google-api-go-client/compute/v1"
+	"golang.org/x/oauth2"
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
 )
 
 var (
@@ -38,29 +42,83 @@ var (
 	gceDefaultClientSecret = "JnMnI5z9iH7YItv_jy_TZ1Hg"
 	gceDefaultScope        = "https://www.googleapis.com/auth/userinfo.profile https://www.googleapis.com/auth/compute https://www.googleapis.com/auth/devstorage.read_write"
 
-	gceInstanceType = flag.String("instancetype",
-		"/zones/us-central1-a/machineTypes/n1-standard-1",
-		"The reference to the instance type to create.")
-	gceImage = flag.String("image",
-		"https://www.googleapis.com/compute/v1/projects/debian-cloud/global/images/backports-debian-7-wheezy-v20131127",
-		"The GCE image to boot from.")
-	gceDiskName   = flag.String("diskname", "docker-root", "Name of the instance root disk")
-	gceDiskSizeGb = flag.Int64("disksize", 100, "Size of the root disk in GB")
+	// Tunables, set through the provider flags.
+	gceInstanceType = "/zones/us-central1-a/machineTypes/n1-standard-1"
+	gceImage        = "https://www.googleapis.com/compute/v1/projects/debian-cloud/global/images/backports-debian-7-wheezy-v20131127"
+	gceDiskName     = "docker-root"
+	gceDiskSizeGb   = int64(100)
+	gceReadyTimeout = 10 * time.Minute
+	// The addresses allowed to reach published ports, as a CIDR, empty
+	// for the address of this machine.
+	gceFirewallSource = ""
+)
+
+// The startup script reports its progress on the serial console, where it can
+// be read back through the compute API.
+const (
+	// Prefixes each host key of the instance.
+	hostKeyMarker = "docker-cloud-host-key:"
+	// Written once Docker is up and serving.
+	readyMarker = "docker-cloud-ready"
+	// Prefixes the line number of the command that failed.
+	failedMarker = "docker-cloud-failed:"
 )
 
 const startup = `#!/bin/bash
+trap 'echo "` + failedMarker + ` line $LINENO, exit code $?" > /dev/ttyS0; exit 1' ERR
+for key in /etc/ssh/ssh_host_*_key.pub; do echo "` + hostKeyMarker + ` $(cat $key)" > /dev/ttyS0; done
 sysctl -w net.ipv4.ip_forward=1
 wget -qO- https://get.docker.io/ | sh
 until test -f /var/run/docker.pid; do sleep 1 && echo waiting; done
 grep mtu /etc/default/docker || (echo 'DOCKER_OPTS="-H :8000 -mtu 1460"' >> /etc/default/docker)
 service docker restart
 until echo 'GET /' >/dev/tcp/localhost/8000; do sleep 1 && echo waiting; done
+echo "` + readyMarker + `" > /dev/ttyS0
 `
 
-// A Google Compute Engine implementation of the Cloud interface
+func init() {
+	RegisterProvider("gce", &gceFactory{})
+}
+
+// Makes GCECloud providers from the command line.
+type gceFactory struct {
+	projectId, zone *string
+}
+
+// Implementation of the ProviderFactory interface
+func (f *gceFactory) Flags(fs *flag.FlagSet) {
+	f.projectId = fs.String("project", "", "Google Cloud Project Name")
+	f.zone = fs.String("zone", "us-central1-a", "The zone to run in")
+	fs.StringVar(&gceInstanceType, "instancetype", gceInstanceType, "The reference to the instance type to create.")
+	fs.StringVar(&gceImage, "image", gceImage, "The GCE image to boot from.")
+	fs.StringVar(&gceDiskName, "diskname", gceDiskName, "Name of the instance root disk")
+	fs.Int64Var(&gceDiskSizeGb, "disksize", gceDiskSizeGb, "Size of the root disk in GB")
+	fs.DurationVar(&gceReadyTimeout, "readytimeout", gceReadyTimeout, "How long to wait for Docker to come up on a new instance.")
+	fs.Func("firewallsource", "The addresses (CIDR) allowed to reach exposed ports, defaults to the address of this machine.", func(source string) error {
+		if _, _, err := net.ParseCIDR(source); err != nil {
+			return err
+		}
+		gceFirewallSource = source
+		return nil
+	})
+}
+
+// Implementation of the ProviderFactory interface
+func (f *gceFactory) New() (Provider, error) {
+	return NewCloudGCE(*f.projectId, *f.zone)
+}
+
+// A Google Compute Engine implementation of the Provider interface
 type GCECloud struct {
 	service   *compute.Service
 	projectId string
+	zone      string
+}
+
+// A Google Compute Engine implementation of the Instance interface
+type gceInstance struct {
+	cloud    GCECloud
+	instance *compute.Instance
 }
 
 type gcloudCredentialsCache struct {
@@ -157,8 +215,8 @@ func (conf *gceConfig) Write() error {
 
 // Create a GCE Cloud instance.  'clientId', 'clientSecret' and 'scope' are used to ask for a client
 // credential.  'code' is optional and is only used if a cached credential can not be found.
-// 'projectId' is the Google Cloud project name.
-func NewCloudGCE(projectId string) (cloud *GCECloud, err error) {
+// 'projectId' is the Google Cloud project name, 'zone' is where instances are created.
+func NewCloudGCE(projectId, zone string) (cloud *GCECloud, err error) {
 	conf := &gceConfig{}
 	if err = conf.Read(); err != nil || conf.Credential.RefreshToken == "" {
 		return nil, errors.New("Did you authorize the client? Run `docker-cloud auth`.")
@@ -171,57 +229,88 @@ func NewCloudGCE(projectId string) (cloud *GCECloud, err error) {
 	}
 
 	oAuth2Conf := newGCEOAuth2Config(conf.Credential.ClientId, conf.Credential.ClientSecret, conf.Key.Scope)
-	transport := &oauth.Transport{
-		Config: oAuth2Conf,
-		// Make the actual request using the cached token to authenticate.
-		// ("Here's the token, let me in!")
-		Token:     &oauth.Token{RefreshToken: conf.Credential.RefreshToken},
-		Transport: http.DefaultTransport,
-	}
+	ctx := context.Background()
+	// Make the actual request using the cached token to authenticate.
+	// ("Here's the token, let me in!")
+	tokens := oAuth2Conf.TokenSource(ctx, &oauth2.Token{RefreshToken: conf.Credential.RefreshToken})
 
 	// TODO(jbd): Does it need to refresh the token, transport will auto do it if
 	// it fails with an auth error on the first request.
-	err = transport.Refresh()
-	if err != nil {
+	if _, err = tokens.Token(); err != nil {
 		return
 	}
-	svc, err := compute.New(transport.Client())
+	svc, err := compute.NewService(ctx, option.WithTokenSource(tokens))
 	if err != nil {
 		return
 	}
 	return &GCECloud{
 		service:   svc,
 		projectId: projectId,
+		zone:      zone,
 	}, nil
 }
 
-// Implementation of the Cloud interface
-func (cloud GCECloud) GetPublicIPAddress(name string, zone string) (string, error) {
-	instance, err := cloud.service.Instances.Get(cloud.projectId, zone, name).Do()
+// Implementation of the Provider interface
+func (cloud GCECloud) GetInstance(ctx context.Context, name string) (Instance, error) {
+	instance, err := cloud.service.Instances.Get(cloud.projectId, cloud.zone, name).Context(ctx).Do()
+	if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusNotFound {
+		return nil, ErrNoSuchInstance
+	}
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	// Found the instance, we're good.
-	return instance.NetworkInterfaces[0].AccessConfigs[0].NatIP, nil
+	return &gceInstance{cloud, instance}, nil
 }
 
-// Get or create a new root disk.
-func (cloud GCECloud) getOrCreateRootDisk(name, zone string) (string, error) {
+// Implementation of the InstanceFinder interface
+func (cloud GCECloud) FindInstances(ctx context.Context, key, value string) ([]Instance, error) {
+	var found []Instance
+	filter := fmt.Sprintf("labels.%s = %q", key, value)
+	err := cloud.service.Instances.List(cloud.projectId, cloud.zone).Filter(filter).Pages(ctx, func(list *compute.InstanceList) error {
+		for _, instance := range list.Items {
+			found = append(found, &gceInstance{cloud, instance})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return found, nil
+}
+
+// Serializes the choice of boot disks, so that only one instance at a time
+// gets to claim the shared root disk.
+var (
+	gceRootDiskMu sync.Mutex
+	// Whether an instance being inserted claimed the shared root disk, which
+	// doesn't list it among its users until the insert is done.
+	gceRootDiskClaimed bool
+)
+
+var errRootDiskInUse = errors.New("root disk is in use")
+
+// Get or create a new root disk. Fails with errRootDiskInUse if an instance
+// is attached to it.
+func (cloud GCECloud) getOrCreateRootDisk(ctx context.Context, name, zone string) (string, error) {
 	log.Printf("try getting root disk: %q", name)
-	disk, err := cloud.service.Disks.Get(cloud.projectId, zone, *gceDiskName).Do()
+	disk, err := cloud.service.Disks.Get(cloud.projectId, zone, gceDiskName).Context(ctx).Do()
 	if err == nil {
 		log.Printf("found %q", disk.SelfLink)
+		if len(disk.Users) > 0 {
+			return "", errRootDiskInUse
+		}
 		return disk.SelfLink, nil
 	}
 	log.Printf("not found, creating root disk: %q", name)
 	op, err := cloud.service.Disks.Insert(cloud.projectId, zone, &compute.Disk{
-		Name: *gceDiskName,
-	}).SourceImage(*gceImage).Do()
+		Name: gceDiskName,
+	}).SourceImage(gceImage).Context(ctx).Do()
 	if err != nil {
 		log.Printf("disk insert api call failed: %v", err)
 		return "", err
 	}
-	err = cloud.waitForOp(op, zone)
+	err = cloud.waitForOp(ctx, op, zone)
 	if err != nil {
 		log.Printf("disk insert operation failed: %v", err)
 		return "", err
@@ -230,26 +319,88 @@ func (cloud GCECloud) getOrCreateRootDisk(name, zone string) (string, error) {
 	return op.TargetLink, nil
 }
 
-// Implementation of the Cloud interface
-func (cloud GCECloud) CreateInstance(name string, zone string) (string, error) {
-	rootDisk, err := cloud.getOrCreateRootDisk(*gceDiskName, zone)
+// Returns the boot disk of a new instance: the shared root disk, unless
+// another instance is using or claimed it, as happens with a pool of
+// instances, in which case the instance gets a disk of its own that goes away
+// with it. The root disk stays claimed until release is called, once the
+// instance is attached to it or failed to be.
+func (cloud GCECloud) bootDisk(ctx context.Context, zone string) (disk *compute.AttachedDisk, release func(), err error) {
+	gceRootDiskMu.Lock()
+	defer gceRootDiskMu.Unlock()
+	rootDisk := ""
+	err = errRootDiskInUse
+	if !gceRootDiskClaimed {
+		rootDisk, err = cloud.getOrCreateRootDisk(ctx, gceDiskName, zone)
+	}
+	if err == errRootDiskInUse {
+		log.Printf("root disk %q is in use, creating a disk for the instance", gceDiskName)
+		return &compute.AttachedDisk{
+			Boot:       true,
+			Type:       "PERSISTENT",
+			Mode:       "READ_WRITE",
+			AutoDelete: true,
+			InitializeParams: &compute.AttachedDiskInitializeParams{
+				SourceImage: gceImage,
+				DiskSizeGb:  gceDiskSizeGb,
+			},
+		}, func() {}, nil
+	}
 	if err != nil {
 		log.Printf("failed to create root disk: %v", err)
-		return "", err
+		return nil, nil, err
+	}
+	gceRootDiskClaimed = true
+	release = func() {
+		gceRootDiskMu.Lock()
+		defer gceRootDiskMu.Unlock()
+		gceRootDiskClaimed = false
+	}
+	return &compute.AttachedDisk{
+		Boot:   true,
+		Type:   "PERSISTENT",
+		Mode:   "READ_WRITE",
+		Source: rootDisk,
+	}, release, nil
+}
+
+// Implementation of the Provider interface
+func (cloud GCECloud) CreateInstance(ctx context.Context, name string) (Instance, error) {
+	if err := cloud.insertInstance(ctx, name, cloud.zone); err != nil {
+		return nil, err
+	}
+
+	// Wait for docker to come up
+	err := cloud.waitForDocker(ctx, name, 0, gceReadyTimeout)
+	if err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return nil, err
+	}
+	created, err := cloud.GetInstance(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("instance started: %q", created.IP())
+	return created, nil
+}
+
+// Inserts the instance, and waits for it to be running.
+func (cloud GCECloud) insertInstance(ctx context.Context, name, zone string) error {
+	// Hold on to the root disk until the instance is attached to it.
+	bootDisk, release, err := cloud.bootDisk(ctx, zone)
+	if err != nil {
+		return err
+	}
+	defer release()
+	sshKeys, err := gceSSHKeysMetadata()
+	if err != nil {
+		return err
 	}
 	prefix := "https://www.googleapis.com/compute/v1/projects/" + cloud.projectId
 	instance := &compute.Instance{
 		Name:        name,
 		Description: "Docker on GCE",
-		MachineType: prefix + *gceInstanceType,
-		Disks: []*compute.AttachedDisk{
-			{
-				Boot:   true,
-				Type:   "PERSISTENT",
-				Mode:   "READ_WRITE",
-				Source: rootDisk,
-			},
-		},
+		MachineType: prefix + gceInstanceType,
+		Disks:       []*compute.AttachedDisk{bootDisk},
 		NetworkInterfaces: []*compute.NetworkInterface{
 			{
 				AccessConfigs: []*compute.AccessConfig{
@@ -262,94 +413,286 @@ func (cloud GCECloud) CreateInstance(name string, zone string) (string, error) {
 			Items: []*compute.MetadataItems{
 				{
 					Key:   "startup-script",
-					Value: startup,
+					Value: googleapi.String(startup),
+				},
+				{
+					Key:   "ssh-keys",
+					Value: googleapi.String(sshKeys),
 				},
 			},
 		},
 	}
+	// A new instance comes with new host keys.
+	if err = cloud.forgetHostKeys(name); err != nil {
+		return err
+	}
 	log.Printf("starting instance: %q", name)
-	op, err := cloud.service.Instances.Insert(cloud.projectId, zone, instance).Do()
+	op, err := cloud.service.Instances.Insert(cloud.projectId, zone, instance).Context(ctx).Do()
 	if err != nil {
 		log.Printf("instance insert api call failed: %v", err)
-		return "", err
+		return err
 	}
-	err = cloud.waitForOp(op, zone)
+	err = cloud.waitForOp(ctx, op, zone)
 	if err != nil {
 		log.Printf("instance insert operation failed: %v", err)
-		return "", err
+		return err
 	}
+	return nil
+}
 
-	// Wait for docker to come up
-	// TODO(bburns) : Use metadata instead to signal that docker is up and read.
-	time.Sleep(60 * time.Second)
+// Polls the serial console of an instance, from offset since on, until the
+// startup script reports that Docker is up, the script fails, or timeout runs
+// out.
+func (cloud GCECloud) waitForDocker(ctx context.Context, name string, since int64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		output, err := cloud.service.Instances.GetSerialPortOutput(cloud.projectId, cloud.zone, name).Start(since).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(output.Contents, "\n") {
+			if i := strings.Index(line, failedMarker); i >= 0 {
+				return fmt.Errorf("startup script failed on %q: %s", name, strings.TrimSpace(line[i+len(failedMarker):]))
+			}
+			if strings.Contains(line, readyMarker) {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for docker on %q", timeout, name)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// Returns the offset the serial console output of an instance is at.
+func (cloud GCECloud) serialOutputEnd(ctx context.Context, name string) (int64, error) {
+	output, err := cloud.service.Instances.GetSerialPortOutput(cloud.projectId, cloud.zone, name).Context(ctx).Do()
+	if err != nil {
+		return 0, err
+	}
+	return output.Next, nil
+}
+
+// Implementation of the Instance interface
+func (inst *gceInstance) Name() string {
+	return inst.instance.Name
+}
+
+// Implementation of the Instance interface
+func (inst *gceInstance) Zone() string {
+	return inst.cloud.zone
+}
+
+// Implementation of the Instance interface
+func (inst *gceInstance) IP() string {
+	for _, iface := range inst.instance.NetworkInterfaces {
+		for _, config := range iface.AccessConfigs {
+			if config.NatIP != "" {
+				return config.NatIP
+			}
+		}
+	}
+	return ""
+}
+
+// Implementation of the Instance interface
+func (inst *gceInstance) Status() string {
+	// GCE calls stopped instances TERMINATED.
+	if inst.instance.Status == "TERMINATED" {
+		return StatusStopped
+	}
+	return inst.instance.Status
+}
 
-	log.Printf("instance started: %q", instance.NetworkInterfaces[0].AccessConfigs[0].NatIP)
-	return instance.NetworkInterfaces[0].AccessConfigs[0].NatIP, err
+// Implementation of the Instance interface
+func (inst *gceInstance) Labels() map[string]string {
+	return inst.instance.Labels
 }
 
-// Implementation of the Cloud interface
-func (cloud GCECloud) DeleteInstance(name string, zone string) error {
-	op, err := cloud.service.Instances.Delete(cloud.projectId, zone, name).Do()
+// Implementation of the Labeler interface
+func (inst *gceInstance) SetLabel(ctx context.Context, key, value string) error {
+	cloud, name := inst.cloud, inst.Name()
+	// Labels are set as a whole, so start from the latest ones.
+	instance, err := cloud.service.Instances.Get(cloud.projectId, cloud.zone, name).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	labels := map[string]string{key: value}
+	for k, v := range instance.Labels {
+		if k != key {
+			labels[k] = v
+		}
+	}
+	op, err := cloud.service.Instances.SetLabels(cloud.projectId, cloud.zone, name, &compute.InstancesSetLabelsRequest{
+		Labels:           labels,
+		LabelFingerprint: instance.LabelFingerprint,
+	}).Context(ctx).Do()
+	if err != nil {
+		log.Printf("instance set labels api call failed: %v", err)
+		return err
+	}
+	return cloud.waitForOp(ctx, op, cloud.zone)
+}
+
+// Implementation of the Instance interface
+func (inst *gceInstance) Delete(ctx context.Context) error {
+	cloud, name := inst.cloud, inst.Name()
+	op, err := cloud.service.Instances.Delete(cloud.projectId, cloud.zone, name).Context(ctx).Do()
 	if err != nil {
 		log.Printf("Got compute.Operation, err: %#v, %v", op, err)
 		return err
 	}
-	return cloud.waitForOp(op, zone)
+	if err = cloud.waitForOp(ctx, op, cloud.zone); err != nil {
+		return err
+	}
+	if err = cloud.deleteFirewall(ctx, gceFirewallName(name)); err != nil {
+		return err
+	}
+	return cloud.forgetHostKeys(name)
 }
 
-func (cloud GCECloud) OpenSecureTunnel(name, zone string, localPort, remotePort int) (*os.Process, error) {
-	return cloud.openSecureTunnel(name, zone, "localhost", localPort, remotePort)
+// Implementation of the Instance interface
+func (inst *gceInstance) Stop(ctx context.Context) error {
+	cloud, name := inst.cloud, inst.Name()
+	log.Printf("stopping instance: %q", name)
+	op, err := cloud.service.Instances.Stop(cloud.projectId, cloud.zone, name).Context(ctx).Do()
+	if err != nil {
+		log.Printf("instance stop api call failed: %v", err)
+		return err
+	}
+	return cloud.waitForOp(ctx, op, cloud.zone)
 }
 
-func (cloud GCECloud) openSecureTunnel(name, zone, hostname string, localPort, remotePort int) (*os.Process, error) {
-	ip, err := cloud.GetPublicIPAddress(name, zone)
+// Implementation of the Instance interface
+func (inst *gceInstance) Start(ctx context.Context) error {
+	cloud, name := inst.cloud, inst.Name()
+	// Only look at what this boot writes to the console, the previous one
+	// already reported Docker ready.
+	since, err := cloud.serialOutputEnd(ctx, name)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	log.Printf("restarting instance: %q", name)
+	op, err := cloud.service.Instances.Start(cloud.projectId, cloud.zone, name).Context(ctx).Do()
+	if err != nil {
+		log.Printf("instance start api call failed: %v", err)
+		return err
+	}
+	if err = cloud.waitForOp(ctx, op, cloud.zone); err != nil {
+		return err
+	}
+	return cloud.waitForDocker(ctx, name, since, gceReadyTimeout)
+}
+
+// Implementation of the Waiter interface
+func (inst *gceInstance) WaitForDocker(ctx context.Context) error {
+	cloud, name := inst.cloud, inst.Name()
+	if !gceBooting(inst.instance.Status) {
+		return nil
+	}
+	// The instance has yet to run anything, so whatever the console holds
+	// is from a previous boot. There is no console at all before the first
+	// one.
+	since, err := cloud.serialOutputEnd(ctx, name)
+	if err != nil {
+		since = 0
+	}
+	for {
+		instance, err := cloud.service.Instances.Get(cloud.projectId, cloud.zone, name).Context(ctx).Do()
+		if err != nil {
+			return err
+		}
+		if instance.Status == StatusRunning {
+			break
+		}
+		if !gceBooting(instance.Status) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
 	}
-	username := os.Getenv("USER")
-	homedir := os.Getenv("HOME")
+	return cloud.waitForDocker(ctx, name, since, gceReadyTimeout)
+}
 
-	sshCommand := fmt.Sprintf("-o LogLevel=quiet -o UserKnownHostsFile=/dev/null -o CheckHostIP=no -o StrictHostKeyChecking=no -i %s/.ssh/google_compute_engine -A -p 22 %s@%s -f -N -L %d:%s:%d", homedir, username, ip, localPort, hostname, remotePort)
-	log.Printf("Running %s", sshCommand)
-	cmd := exec.Command("ssh", strings.Split(sshCommand, " ")...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+// Whether an instance in status is on its way to running.
+func gceBooting(status string) bool {
+	return status == "PROVISIONING" || status == "STAGING"
+}
 
-	cmd.Run()
-	return cmd.Process, nil
+// Implementation of the Suspender interface
+func (inst *gceInstance) Suspend(ctx context.Context) error {
+	cloud, name := inst.cloud, inst.Name()
+	log.Printf("suspending instance: %q", name)
+	op, err := cloud.service.Instances.Suspend(cloud.projectId, cloud.zone, name).Context(ctx).Do()
+	if err != nil {
+		log.Printf("instance suspend api call failed: %v", err)
+		return err
+	}
+	return cloud.waitForOp(ctx, op, cloud.zone)
+}
+
+// Implementation of the Suspender interface
+func (inst *gceInstance) Resume(ctx context.Context) error {
+	cloud, name := inst.cloud, inst.Name()
+	log.Printf("resuming instance: %q", name)
+	op, err := cloud.service.Instances.Resume(cloud.projectId, cloud.zone, name).Context(ctx).Do()
+	if err != nil {
+		log.Printf("instance resume api call failed: %v", err)
+		return err
+	}
+	// Docker was never shut down, so it is up as soon as the instance is.
+	return cloud.waitForOp(ctx, op, cloud.zone)
+}
+
+// Implementation of the Instance interface
+func (inst *gceInstance) OpenTunnel(ctx context.Context) (Tunnel, error) {
+	return inst.cloud.openSecureTunnel(ctx, inst.Name(), inst.IP())
 }
 
 // Wait for a compute operation to finish.
 //   op The operation
-//   zone The zone for the operation
-// Returns an error if one occurs, or nil
-func (cloud GCECloud) waitForOp(op *compute.Operation, zone string) error {
-	op, err := cloud.service.ZoneOperations.Get(cloud.projectId, zone, op.Name).Do()
+//   zone The zone for the operation, empty for a global operation
+// Returns an error if one occurs, or nil.  Gives up when ctx is done.
+func (cloud GCECloud) waitForOp(ctx context.Context, op *compute.Operation, zone string) error {
+	var err error
 	for op.Status != "DONE" {
-		time.Sleep(5 * time.Second)
-		op, err = cloud.service.ZoneOperations.Get(cloud.projectId, zone, op.Name).Do()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(5 * time.Second):
+		}
+		if zone == "" {
+			op, err = cloud.service.GlobalOperations.Get(cloud.projectId, op.Name).Context(ctx).Do()
+		} else {
+			op, err = cloud.service.ZoneOperations.Get(cloud.projectId, zone, op.Name).Context(ctx).Do()
+		}
 		if err != nil {
 			log.Printf("Got compute.Operation, err: %#v, %v", op, err)
+			return err
 		}
 		if op.Status != "PENDING" && op.Status != "RUNNING" && op.Status != "DONE" {
-			log.Printf("Error waiting for operation: %s\n", op)
-			return errors.New(fmt.Sprintf("Bad operation: %s", op))
+			log.Printf("Error waiting for operation: %#v\n", op)
+			return fmt.Errorf("Bad operation: %#v", op)
 		}
 	}
-	return err
+	return nil
 }
 
 func ConfigureGCE(clientId, clientSecret, scope, projectId string) error {
 	// Set up a configuration.
 	config := newGCEOAuth2Config(clientId, clientSecret, scope)
 
-	// Set up a Transport using the config.
-	// transport := &oauth.Transport{Config: config,
-	//         Transport: &LogTransport{http.DefaultTransport},}
-	transport := &oauth.Transport{Config: config, Transport: http.DefaultTransport}
 	// ("Please ask the user if I can access this resource.")
-	url := config.AuthCodeURL("")
-	fmt.Println("Visit this URL to get a code, and enter the code.\n")
+	url := config.AuthCodeURL("", oauth2.AccessTypeOffline)
+	fmt.Print("Visit this URL to get a code, and enter the code.\n\n")
 	fmt.Println(url)
 
 	fmt.Print("Enter code: ")
@@ -358,7 +701,7 @@ func ConfigureGCE(clientId, clientSecret, scope, projectId string) error {
 	// Exchange the authorization code for an access token.
 	// ("Here's the code you gave the user, now give me a token!")
 	// TODO(bburns) : Put up a separate web end point to do the oauth dance, so a user can just go to a web page.
-	token, err := transport.Exchange(code)
+	token, err := config.Exchange(context.Background(), code)
 	if err != nil {
 		return err
 	}
@@ -375,7 +718,7 @@ func ConfigureGCE(clientId, clientSecret, scope, projectId string) error {
 	return conf.Write()
 }
 
-func newGCEOAuth2Config(clientId, clientSecret, scope string) *oauth.Config {
+func newGCEOAuth2Config(clientId, clientSecret, scope string) *oauth2.Config {
 	if clientId == "" {
 		clientId = gceDefaultClientID
 	}
@@ -385,13 +728,14 @@ func newGCEOAuth2Config(clientId, clientSecret, scope string) *oauth.Config {
 	if scope == "" {
 		scope = gceDefaultScope
 	}
-	return &oauth.Config{
-		ClientId:     clientId,
+	return &oauth2.Config{
+		ClientID:     clientId,
 		ClientSecret: clientSecret,
-		Scope:        scope,
+		Scopes:       strings.Fields(scope),
 		RedirectURL:  "oob",
-		AuthURL:      "https://accounts.google.com/o/oauth2/auth",
-		TokenURL:     "https://accounts.google.com/o/oauth2/token",
-		AccessType:   "offline",
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  "https://accounts.google.com/o/oauth2/auth",
+			TokenURL: "https://accounts.google.com/o/oauth2/token",
+		},
 	}
 }
@@ -0,0 +1,172 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	compute "google.golang.org/api/compute/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// The longest name GCE accepts for a firewall rule or a tag.
+const gceMaxNameLen = 63
+
+// Names the firewall rule opening the ports published on the instance called
+// name, which is also the tag the rule targets the instance by.
+func gceFirewallName(name string) string {
+	rule := "docker-cloud-" + name
+	if len(rule) > gceMaxNameLen {
+		sum := sha256.Sum256([]byte(name))
+		hash := hex.EncodeToString(sum[:4])
+		rule = rule[:gceMaxNameLen-len(hash)-1] + "-" + hash
+	}
+	return rule
+}
+
+// Implementation of the PortPublisher interface
+func (inst *gceInstance) PublishPorts(ctx context.Context, ports []Port) error {
+	cloud, name := inst.cloud, inst.Name()
+	rule := gceFirewallName(name)
+	if len(ports) == 0 {
+		return cloud.deleteFirewall(ctx, rule)
+	}
+	if err := cloud.addTag(ctx, name, rule); err != nil {
+		return err
+	}
+	source, err := inst.firewallSource(ctx)
+	if err != nil {
+		return err
+	}
+
+	byProtocol := make(map[string][]string)
+	for _, port := range ports {
+		byProtocol[port.Protocol] = append(byProtocol[port.Protocol], strconv.Itoa(port.Number))
+	}
+	var allowed []*compute.FirewallAllowed
+	for protocol, numbers := range byProtocol {
+		sort.Strings(numbers)
+		allowed = append(allowed, &compute.FirewallAllowed{IPProtocol: protocol, Ports: numbers})
+	}
+	sort.Slice(allowed, func(i, j int) bool { return allowed[i].IPProtocol < allowed[j].IPProtocol })
+	prefix := "https://www.googleapis.com/compute/v1/projects/" + cloud.projectId
+	firewall := &compute.Firewall{
+		Name:         rule,
+		Description:  "Ports published by the containers on " + name,
+		Network:      prefix + "/global/networks/default",
+		Allowed:      allowed,
+		SourceRanges: []string{source},
+		TargetTags:   []string{rule},
+	}
+
+	existing, err := cloud.service.Firewalls.Get(cloud.projectId, rule).Context(ctx).Do()
+	var op *compute.Operation
+	switch {
+	case isGCENotFound(err):
+		log.Printf("opening ports of %q to %s", name, source)
+		op, err = cloud.service.Firewalls.Insert(cloud.projectId, firewall).Context(ctx).Do()
+	case err != nil:
+		return err
+	case reflect.DeepEqual(existing.Allowed, firewall.Allowed) && reflect.DeepEqual(existing.SourceRanges, firewall.SourceRanges):
+		return nil
+	default:
+		log.Printf("updating the open ports of %q", name)
+		op, err = cloud.service.Firewalls.Update(cloud.projectId, rule, firewall).Context(ctx).Do()
+	}
+	if err != nil {
+		log.Printf("firewall api call failed: %v", err)
+		return err
+	}
+	return cloud.waitForOp(ctx, op, "")
+}
+
+// Tags the instance called name with tag, unless it already is.
+func (cloud GCECloud) addTag(ctx context.Context, name, tag string) error {
+	// Tags are set as a whole, so start from the latest ones.
+	instance, err := cloud.service.Instances.Get(cloud.projectId, cloud.zone, name).Context(ctx).Do()
+	if err != nil {
+		return err
+	}
+	tags := &compute.Tags{}
+	if instance.Tags != nil {
+		for _, t := range instance.Tags.Items {
+			if t == tag {
+				return nil
+			}
+		}
+		tags.Fingerprint = instance.Tags.Fingerprint
+		tags.Items = append(tags.Items, instance.Tags.Items...)
+	}
+	tags.Items = append(tags.Items, tag)
+	op, err := cloud.service.Instances.SetTags(cloud.projectId, cloud.zone, name, tags).Context(ctx).Do()
+	if err != nil {
+		log.Printf("instance set tags api call failed: %v", err)
+		return err
+	}
+	return cloud.waitForOp(ctx, op, cloud.zone)
+}
+
+// Deletes the firewall rule, if there is one.
+func (cloud GCECloud) deleteFirewall(ctx context.Context, rule string) error {
+	op, err := cloud.service.Firewalls.Delete(cloud.projectId, rule).Context(ctx).Do()
+	if isGCENotFound(err) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("firewall delete api call failed: %v", err)
+		return err
+	}
+	log.Printf("closing ports: %q", rule)
+	return cloud.waitForOp(ctx, op, "")
+}
+
+func isGCENotFound(err error) bool {
+	e, ok := err.(*googleapi.Error)
+	return ok && e.Code == http.StatusNotFound
+}
+
+// Returns the addresses allowed to reach the published ports: the ones set
+// with -firewallsource, or else the address this machine reaches the
+// instance from. The address is looked up every time, as it changes when the
+// machine moves to another network, which also breaks the tunnel, and the
+// ports are published again once it is back up.
+func (inst *gceInstance) firewallSource(ctx context.Context) (string, error) {
+	if gceFirewallSource != "" {
+		return gceFirewallSource, nil
+	}
+	// What the instance sees is what the firewall sees, NAT and all.
+	tunnel, err := inst.cloud.openSecureTunnel(ctx, inst.Name(), inst.IP())
+	if err != nil {
+		return "", err
+	}
+	defer tunnel.Close()
+	ip, err := tunnel.clientIP()
+	if err != nil {
+		return "", fmt.Errorf("finding out the address of this machine: %v", err)
+	}
+	if strings.Contains(ip, ":") {
+		return ip + "/128", nil
+	}
+	return ip + "/32", nil
+}
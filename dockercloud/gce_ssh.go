@@ -0,0 +1,188 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func gceSSHKeyAbsPath() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(usr.HomeDir, ".ssh/google_compute_engine"), nil
+}
+
+// The user to log into instances as: the local user, who may not have $USER
+// set when running from cron or a container.
+func gceSSHUser() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", fmt.Errorf("unable to find the ssh user: %v", err)
+	}
+	// Windows prefixes the domain.
+	name := usr.Username[strings.LastIndex(usr.Username, `\`)+1:]
+	if name == "" {
+		return "", fmt.Errorf("unable to find the ssh user: user %s has no name", usr.Uid)
+	}
+	return name, nil
+}
+
+// Loads the private key used to log into instances, generating a new key
+// pair the first time around.
+func gceSSHSigner() (ssh.Signer, error) {
+	keyPath, err := gceSSHKeyAbsPath()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(keyPath)
+	if os.IsNotExist(err) {
+		data, err = generateSSHKey(keyPath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to load ssh key: %q: %v", keyPath, err)
+	}
+	return ssh.ParsePrivateKey(data)
+}
+
+// Generates an RSA key pair, laid out like gcloud does: the PEM encoded
+// private key at keyPath and the public key next to it with a .pub suffix.
+// Returns the encoded private key.
+func generateSSHKey(keyPath string) ([]byte, error) {
+	log.Printf("generating ssh key: %q", keyPath)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := ssh.NewPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+	if err = os.MkdirAll(path.Dir(keyPath), 0700); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(keyPath, data, 0600); err != nil {
+		return nil, err
+	}
+	if err = ioutil.WriteFile(keyPath+".pub", ssh.MarshalAuthorizedKey(pub), 0644); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Returns the `ssh-keys` metadata entry that authorizes the local user to
+// log into an instance.
+func gceSSHKeysMetadata() (string, error) {
+	signer, err := gceSSHSigner()
+	if err != nil {
+		return "", err
+	}
+	sshUser, err := gceSSHUser()
+	if err != nil {
+		return "", err
+	}
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey())))
+	return fmt.Sprintf("%s:%s %s", sshUser, authorizedKey, sshUser), nil
+}
+
+// The internal DNS name of an instance, which is how it is known in the
+// known_hosts store. Unlike its NAT IP, it can't be handed to another instance
+// while this one is alive.
+func (cloud GCECloud) instanceHostname(name string) string {
+	return fmt.Sprintf("%s.%s.c.%s.internal", name, cloud.zone, cloud.projectId)
+}
+
+// Reads the host keys that the startup script published on the serial
+// console. The compute API is authenticated, so unlike the SSH handshake it
+// can't be tampered with.
+func (cloud GCECloud) getHostKeys(ctx context.Context, name string) ([]ssh.PublicKey, error) {
+	output, err := cloud.service.Instances.GetSerialPortOutput(cloud.projectId, cloud.zone, name).Context(ctx).Do()
+	if err != nil {
+		return nil, err
+	}
+	var keys []ssh.PublicKey
+	for _, line := range strings.Split(output.Contents, "\n") {
+		i := strings.Index(line, hostKeyMarker)
+		if i < 0 {
+			continue
+		}
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(line[i+len(hostKeyMarker):]))
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("instance %q has not published its host keys yet", name)
+	}
+	return keys, nil
+}
+
+// Forgets the host keys pinned for the instance called name.
+func (cloud GCECloud) forgetHostKeys(name string) error {
+	khPath, err := knownHostsAbsPath()
+	if err != nil {
+		return err
+	}
+	return forgetKnownHost(khPath, cloud.instanceHostname(name))
+}
+
+// Opens an SSH tunnel to the instance called name, reachable at ip.
+func (cloud GCECloud) openSecureTunnel(ctx context.Context, name, ip string) (*SSHTunnel, error) {
+	signer, err := gceSSHSigner()
+	if err != nil {
+		return nil, err
+	}
+	sshUser, err := gceSSHUser()
+	if err != nil {
+		return nil, err
+	}
+	khPath, err := knownHostsAbsPath()
+	if err != nil {
+		return nil, err
+	}
+	hostKeyCallback, err := pinnedHostKeyCallback(khPath, cloud.instanceHostname(name), func() ([]ssh.PublicKey, error) {
+		return cloud.getHostKeys(ctx, name)
+	})
+	if err != nil {
+		return nil, err
+	}
+	config := &ssh.ClientConfig{
+		User:            sshUser,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	}
+	log.Printf("opening tunnel to %q at %s", name, ip)
+	return newSSHTunnel(ctx, net.JoinHostPort(ip, "22"), config)
+}
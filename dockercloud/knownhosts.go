@@ -0,0 +1,126 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Where the known_hosts store is, unless told otherwise.
+func knownHostsAbsPath() (string, error) {
+	usr, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return path.Join(usr.HomeDir, ".docker-cloud/known_hosts"), nil
+}
+
+// Opens the known_hosts store at khPath, creating it if needed.
+func openKnownHosts(khPath string) (ssh.HostKeyCallback, error) {
+	if err := os.MkdirAll(path.Dir(khPath), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(khPath, os.O_CREATE|os.O_RDONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	return knownhosts.New(khPath)
+}
+
+// Returns a HostKeyCallback that only accepts the key pinned for host in the
+// known_hosts store at khPath. The first time host is seen, its key must be one of the
+// keys returned by trusted, which should learn them through a channel other
+// than the SSH connection itself. That key is then pinned, and any other key
+// is refused from there on.
+func pinnedHostKeyCallback(khPath, host string, trusted func() ([]ssh.PublicKey, error)) (ssh.HostKeyCallback, error) {
+	check, err := openKnownHosts(khPath)
+	if err != nil {
+		return nil, err
+	}
+	hostport := net.JoinHostPort(host, "22")
+	return func(_ string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostport, remote, key)
+		keyErr, ok := err.(*knownhosts.KeyError)
+		if !ok {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf("host key mismatch for %s, refusing to connect", host)
+		}
+		// Never seen this host, so learn its key.
+		keys, err := trusted()
+		if err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if bytes.Equal(k.Marshal(), key.Marshal()) {
+				return appendKnownHost(khPath, host, key)
+			}
+		}
+		return fmt.Errorf("host key for %s is not one of its published keys, refusing to connect", host)
+	}, nil
+}
+
+func appendKnownHost(khPath, host string, key ssh.PublicKey) error {
+	f, err := os.OpenFile(khPath, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = fmt.Fprintln(f, knownhosts.Line([]string{host}, key))
+	return err
+}
+
+// Removes the keys pinned for host from the known_hosts store at khPath,
+// typically because the instance behind it was deleted and its successor will
+// have new keys.
+func forgetKnownHost(khPath, host string) error {
+	data, err := ioutil.ReadFile(khPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && matchesHost(fields[0], host) {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return ioutil.WriteFile(khPath, []byte(strings.Join(kept, "\n")), 0600)
+}
+
+func matchesHost(hosts, host string) bool {
+	for _, h := range strings.Split(hosts, ",") {
+		if h == host {
+			return true
+		}
+	}
+	return false
+}
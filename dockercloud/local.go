@@ -0,0 +1,390 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// Tunables, set through the provider flags.
+	localImage        = "docker:dind"
+	localReadyTimeout = 2 * time.Minute
+)
+
+const (
+	// The port Docker listens on inside local instances, same as on GCE.
+	localDockerPort = 8000
+	// Marks the containers that are local instances, and their networks, with
+	// their instance name.
+	localLabel = "docker-cloud-instance"
+)
+
+// The network of the local instance called name. Each instance gets one of
+// its own, as its daemon listens without TLS: nothing but the host, which
+// reaches it through the published port, should get to it.
+func localNetwork(name string) string {
+	return "docker-cloud-" + name
+}
+
+func init() {
+	RegisterProvider("local", localFactory{})
+}
+
+// Makes LocalCloud providers from the command line.
+type localFactory struct{}
+
+// Implementation of the ProviderFactory interface
+func (localFactory) Flags(fs *flag.FlagSet) {
+	fs.StringVar(&localImage, "image", localImage, "The Docker-in-Docker image local instances run.")
+	fs.DurationVar(&localReadyTimeout, "readytimeout", localReadyTimeout, "How long to wait for Docker to come up in a new instance.")
+}
+
+// Implementation of the ProviderFactory interface
+func (localFactory) New() (Provider, error) {
+	return NewCloudLocal()
+}
+
+// A local implementation of the Provider interface.  Instances are privileged Docker-in-Docker
+// containers on the host, driven through the docker command line, and tunnels are the ports
+// they publish on the loopback interface.  Nothing leaves the host, which makes it a free,
+// offline backend with the same proxy behavior as the real clouds.
+type LocalCloud struct {
+	image string
+}
+
+// A local implementation of the Instance interface
+type localInstance struct {
+	cloud     *LocalCloud
+	container *localContainer
+}
+
+// What `docker inspect` says about a container, or at least the parts we use.
+type localContainer struct {
+	Name  string
+	State struct {
+		Running bool
+		Paused  bool
+		Status  string
+	}
+	Config struct {
+		Labels map[string]string
+	}
+	NetworkSettings struct {
+		IPAddress string
+		Networks  map[string]struct {
+			IPAddress string
+		}
+		Ports map[string][]struct {
+			HostIp   string
+			HostPort string
+		}
+	}
+}
+
+// Create a local cloud.  The docker command line must be installed and talking to a daemon
+// that allows privileged containers.
+func NewCloudLocal() (*LocalCloud, error) {
+	if _, err := exec.LookPath("docker"); err != nil {
+		return nil, errors.New("the local provider needs the docker command line in $PATH")
+	}
+	return &LocalCloud{image: localImage}, nil
+}
+
+// Runs the docker command line against the host daemon.
+func localDocker(ctx context.Context, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "docker", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("docker %s: %v: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (cloud *LocalCloud) inspect(ctx context.Context, name string) (*localContainer, error) {
+	out, err := localDocker(ctx, "container", "inspect", name)
+	if err != nil {
+		if strings.Contains(err.Error(), "No such") {
+			return nil, ErrNoSuchInstance
+		}
+		return nil, err
+	}
+	var containers []*localContainer
+	if err = json.Unmarshal(out, &containers); err != nil {
+		return nil, err
+	}
+	if len(containers) != 1 {
+		return nil, ErrNoSuchInstance
+	}
+	if containers[0].Config.Labels[localLabel] != name {
+		return nil, fmt.Errorf("container %q is not a docker-cloud instance", name)
+	}
+	return containers[0], nil
+}
+
+// Implementation of the Provider interface
+func (cloud *LocalCloud) GetInstance(ctx context.Context, name string) (Instance, error) {
+	container, err := cloud.inspect(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &localInstance{cloud, container}, nil
+}
+
+// Implementation of the Provider interface
+func (cloud *LocalCloud) CreateInstance(ctx context.Context, name string) (Instance, error) {
+	log.Printf("starting local instance: %q", name)
+	// A network left behind by an instance that failed to start will do.
+	_, err := localDocker(ctx, "network", "create", "--label", localLabel+"="+name, localNetwork(name))
+	if err != nil && !strings.Contains(err.Error(), "already exists") {
+		return nil, err
+	}
+	_, err = localDocker(ctx, "run", "--detach", "--privileged",
+		"--name", name,
+		"--label", localLabel+"="+name,
+		"--network", localNetwork(name),
+		"--env", "DOCKER_TLS_CERTDIR=",
+		"--publish", fmt.Sprintf("127.0.0.1::%d", localDockerPort),
+		cloud.image,
+		fmt.Sprintf("--host=tcp://0.0.0.0:%d", localDockerPort),
+		"--host=unix:///var/run/docker.sock",
+		"--tls=false")
+	if err != nil {
+		log.Printf("local instance failed to start: %v", err)
+		return nil, err
+	}
+	instance, err := cloud.GetInstance(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if err = waitForLocalDocker(ctx, instance.(*localInstance), localReadyTimeout); err != nil {
+		log.Printf("docker failed to start: %v", err)
+		return nil, err
+	}
+	log.Printf("local instance started: %q", instance.IP())
+	return instance, nil
+}
+
+// Pings the daemon in a local instance until it answers or timeout runs out.
+func waitForLocalDocker(ctx context.Context, inst *localInstance, timeout time.Duration) error {
+	tunnel, err := inst.OpenTunnel(ctx)
+	if err != nil {
+		return err
+	}
+	defer tunnel.Close()
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return tunnel.Dial(ctx, localDockerPort)
+			},
+		},
+		Timeout: 5 * time.Second,
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		res, err := client.Get("http://docker/_ping")
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode == http.StatusOK {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out after %v waiting for docker on %q", timeout, inst.Name())
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Implementation of the Instance interface
+func (inst *localInstance) Name() string {
+	return strings.TrimPrefix(inst.container.Name, "/")
+}
+
+// Implementation of the Instance interface
+func (inst *localInstance) Zone() string {
+	return "local"
+}
+
+// Implementation of the Instance interface
+func (inst *localInstance) IP() string {
+	if network, ok := inst.container.NetworkSettings.Networks[localNetwork(inst.Name())]; ok {
+		return network.IPAddress
+	}
+	// Instances made before they got a network of their own.
+	return inst.container.NetworkSettings.IPAddress
+}
+
+// Implementation of the Instance interface
+func (inst *localInstance) Status() string {
+	state := inst.container.State
+	switch {
+	case state.Paused:
+		return StatusSuspended
+	case state.Running:
+		return StatusRunning
+	case state.Status == "exited" || state.Status == "created":
+		return StatusStopped
+	}
+	return strings.ToUpper(state.Status)
+}
+
+// Implementation of the Instance interface
+func (inst *localInstance) Labels() map[string]string {
+	return inst.container.Config.Labels
+}
+
+// Implementation of the Instance interface
+func (inst *localInstance) Delete(ctx context.Context) error {
+	log.Printf("deleting local instance: %q", inst.Name())
+	// Take the volume holding the inner /var/lib/docker along.
+	if _, err := localDocker(ctx, "rm", "--force", "--volumes", inst.Name()); err != nil {
+		return err
+	}
+	_, err := localDocker(ctx, "network", "rm", localNetwork(inst.Name()))
+	if err != nil && strings.Contains(err.Error(), "not found") {
+		return nil
+	}
+	return err
+}
+
+// Implementation of the Instance interface
+func (inst *localInstance) Stop(ctx context.Context) error {
+	log.Printf("stopping local instance: %q", inst.Name())
+	_, err := localDocker(ctx, "stop", inst.Name())
+	return err
+}
+
+// Implementation of the Instance interface
+func (inst *localInstance) Start(ctx context.Context) error {
+	log.Printf("restarting local instance: %q", inst.Name())
+	if _, err := localDocker(ctx, "start", inst.Name()); err != nil {
+		return err
+	}
+	// The published ports change across restarts.
+	container, err := inst.cloud.inspect(ctx, inst.Name())
+	if err != nil {
+		return err
+	}
+	inst.container = container
+	return waitForLocalDocker(ctx, inst, localReadyTimeout)
+}
+
+// Implementation of the Suspender interface
+func (inst *localInstance) Suspend(ctx context.Context) error {
+	log.Printf("pausing local instance: %q", inst.Name())
+	_, err := localDocker(ctx, "pause", inst.Name())
+	return err
+}
+
+// Implementation of the Suspender interface
+func (inst *localInstance) Resume(ctx context.Context) error {
+	log.Printf("unpausing local instance: %q", inst.Name())
+	_, err := localDocker(ctx, "unpause", inst.Name())
+	return err
+}
+
+// Implementation of the Instance interface
+func (inst *localInstance) OpenTunnel(ctx context.Context) (Tunnel, error) {
+	if inst.Status() != StatusRunning {
+		return nil, fmt.Errorf("local instance %q is not running", inst.Name())
+	}
+	ports := make(map[int]string)
+	for port, bindings := range inst.container.NetworkSettings.Ports {
+		p, err := strconv.Atoi(strings.TrimSuffix(port, "/tcp"))
+		if err != nil || len(bindings) == 0 {
+			continue
+		}
+		ports[p] = net.JoinHostPort("127.0.0.1", bindings[0].HostPort)
+	}
+	if _, ok := ports[localDockerPort]; !ok {
+		return nil, fmt.Errorf("local instance %q doesn't publish the docker port", inst.Name())
+	}
+	return &localTunnel{ip: inst.IP(), ports: ports}, nil
+}
+
+// A tunnel to a local instance.  Ports the instance publishes are reached through the host
+// port they are forwarded from, any other port directly on the container address.
+type localTunnel struct {
+	ip    string
+	ports map[int]string
+	conns tunnelConns
+
+	mu sync.Mutex
+	// Set once the docker port can't be reached anymore.
+	err error
+}
+
+func (t *localTunnel) addr(port int) string {
+	if addr, ok := t.ports[port]; ok {
+		return addr
+	}
+	return net.JoinHostPort(t.ip, strconv.Itoa(port))
+}
+
+// Implementation of the Tunnel interface
+func (t *localTunnel) Dial(ctx context.Context, port int) (net.Conn, error) {
+	if t.conns.isClosed() {
+		return nil, errTunnelClosed
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", t.addr(port))
+	if err != nil {
+		// The forward goes away with the container, or moves when it
+		// restarts, so the tunnel is done for.
+		if port == localDockerPort && ctx.Err() == nil {
+			t.mu.Lock()
+			t.err = err
+			t.mu.Unlock()
+		}
+		return nil, err
+	}
+	return t.conns.add(conn)
+}
+
+// Implementation of the Tunnel interface
+func (t *localTunnel) Close() error {
+	t.conns.close()
+	return nil
+}
+
+// Implementation of the Tunnel interface
+func (t *localTunnel) Healthy() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err == nil && !t.conns.isClosed()
+}
@@ -0,0 +1,61 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A ProviderFactory makes a Provider out of command line flags.
+type ProviderFactory interface {
+	// Flags defines the flags specific to the provider on fs.
+	Flags(fs *flag.FlagSet)
+
+	// New creates the provider, once the flags are parsed.
+	New() (Provider, error)
+}
+
+var providers = make(map[string]ProviderFactory)
+
+// RegisterProvider makes a provider available under name.  It is meant to be called from init
+// functions, and panics if name is already taken.
+func RegisterProvider(name string, factory ProviderFactory) {
+	if _, ok := providers[name]; ok {
+		panic("dockercloud: provider registered twice: " + name)
+	}
+	providers[name] = factory
+}
+
+// LookupProvider returns the factory of the provider registered under name.
+func LookupProvider(name string) (ProviderFactory, error) {
+	factory, ok := providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q, pick one of: %s", name, strings.Join(ProviderNames(), ", "))
+	}
+	return factory, nil
+}
+
+// ProviderNames returns the names of the registered providers, sorted.
+func ProviderNames() []string {
+	var names []string
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
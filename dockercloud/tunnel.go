@@ -0,0 +1,240 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package dockercloud
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var errTunnelClosed = errors.New("tunnel closed")
+
+var (
+	// How often to check that the SSH server still answers, so that a
+	// connection silently dropped by the network is noticed before a request
+	// hangs on it.
+	sshKeepaliveInterval = 30 * time.Second
+	// How long the SSH server has to answer.
+	sshKeepaliveTimeout = 15 * time.Second
+)
+
+// An SSHTunnel carries connections to ports on the remote host over an SSH
+// connection, each over its own SSH channel.
+type SSHTunnel struct {
+	client *ssh.Client
+	// Closed once the tunnel is broken or closed.
+	done chan struct{}
+
+	mu  sync.Mutex
+	err error
+}
+
+// Dials the SSH server at addr. ctx only bounds the dial and the handshake,
+// the tunnel stays up until closed.
+func newSSHTunnel(ctx context.Context, addr string, config *ssh.ClientConfig) (*SSHTunnel, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tunnel := &SSHTunnel{client: ssh.NewClient(c, chans, reqs), done: make(chan struct{})}
+	go func() {
+		err := tunnel.client.Wait()
+		if err == nil {
+			err = errors.New("ssh connection closed")
+		}
+		tunnel.fail(err)
+	}()
+	go tunnel.keepalive(sshKeepaliveInterval, sshKeepaliveTimeout)
+	return tunnel, nil
+}
+
+// Sends a keepalive request every interval until the tunnel is down, failing
+// it when one goes unanswered for timeout. Any answer will do, servers refuse
+// requests they don't know of.
+func (t *SSHTunnel) keepalive(interval, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.done:
+			return
+		case <-ticker.C:
+		}
+		answered := make(chan error, 1)
+		go func() {
+			_, _, err := t.client.SendRequest("keepalive@openssh.com", true, nil)
+			answered <- err
+		}()
+		timer := time.NewTimer(timeout)
+		select {
+		case <-t.done:
+			timer.Stop()
+			return
+		case err := <-answered:
+			timer.Stop()
+			if err != nil {
+				t.fail(err)
+				return
+			}
+		case <-timer.C:
+			t.fail(fmt.Errorf("ssh server didn't answer a keepalive within %v", timeout))
+			return
+		}
+	}
+}
+
+// Implementation of the Tunnel interface
+func (t *SSHTunnel) Dial(ctx context.Context, port int) (net.Conn, error) {
+	if err := t.Err(); err != nil {
+		return nil, err
+	}
+	return t.client.DialContext(ctx, "tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+}
+
+// Implementation of the Tunnel interface
+func (t *SSHTunnel) Close() error {
+	t.fail(errTunnelClosed)
+	return nil
+}
+
+// Implementation of the Tunnel interface
+func (t *SSHTunnel) Healthy() bool {
+	return t.Err() == nil
+}
+
+// Err returns the error that broke the tunnel, or nil if it is still up.
+func (t *SSHTunnel) Err() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.err
+}
+
+// Records the first error that breaks the tunnel and tears it down.
+func (t *SSHTunnel) fail(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return
+	}
+	if err != errTunnelClosed {
+		log.Printf("tunnel failed: %v", err)
+	}
+	t.err = err
+	close(t.done)
+	t.client.Close()
+}
+
+var errNoSSHClient = errors.New("the SSH server didn't tell the client address")
+
+// Returns the address the SSH server sees the client at.
+func (t *SSHTunnel) clientIP() (string, error) {
+	session, err := t.client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	out, err := session.Output("echo $SSH_CLIENT")
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 || net.ParseIP(fields[0]) == nil {
+		return "", errNoSSHClient
+	}
+	return fields[0], nil
+}
+
+// The connections made through a tunnel, so that closing the tunnel closes
+// them too. The zero value is ready to use.
+type tunnelConns struct {
+	mu     sync.Mutex
+	closed bool
+	conns  map[*tunnelConn]bool
+}
+
+// Tracks conn until it or the tunnel is closed. Closes conn and fails if the
+// tunnel is closed already.
+func (c *tunnelConns) add(conn net.Conn) (net.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		conn.Close()
+		return nil, errTunnelClosed
+	}
+	if c.conns == nil {
+		c.conns = make(map[*tunnelConn]bool)
+	}
+	tracked := &tunnelConn{Conn: conn, conns: c}
+	c.conns[tracked] = true
+	return tracked, nil
+}
+
+// Whether the tunnel is closed.
+func (c *tunnelConns) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// Closes the tunnel, and every connection made through it.
+func (c *tunnelConns) close() {
+	c.mu.Lock()
+	conns := c.conns
+	c.closed, c.conns = true, nil
+	c.mu.Unlock()
+	for conn := range conns {
+		conn.Conn.Close()
+	}
+}
+
+// A connection made through a tunnel.
+type tunnelConn struct {
+	net.Conn
+	conns *tunnelConns
+}
+
+func (conn *tunnelConn) Close() error {
+	conn.conns.mu.Lock()
+	delete(conn.conns.conns, conn)
+	conn.conns.mu.Unlock()
+	return conn.Conn.Close()
+}
+
+// Shuts down the writing side of the connection, if it can.
+func (conn *tunnelConn) CloseWrite() error {
+	if cw, ok := conn.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.New("connection can't be half-closed")
+}
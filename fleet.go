@@ -0,0 +1,611 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/googlecloudplatform/docker-cloud/dockercloud"
+)
+
+// A fleet spreads containers over several instances, each behind a
+// ProxyServer of its own. New containers go to the first instance with room
+// for them, and later requests about a container go to the instance that
+// runs it.
+type fleet struct {
+	// The first instance is called name, the next ones name-1, name-2...
+	name     string
+	provider dockercloud.Provider
+	maxHosts int
+	// What a container takes up, unless it asks for more or less.
+	containerCpus   float64
+	containerMemory int64
+	// Makes the proxy in front of the instance called name.
+	newHost func(name string) *ProxyServer
+	// What clients may ask the daemons for, nil lets them ask for anything.
+	// The hosts enforce it too, but it is checked before placing containers.
+	policy *policy
+
+	// Held while looking for the instances of a previous run.
+	discoverMu sync.Mutex
+	discovered bool
+
+	mu    sync.Mutex
+	hosts []*ProxyServer
+	// Where requests that aren't about a container go, such as pulling an
+	// image: the instance the last container went to.
+	current *ProxyServer
+	// Which instance runs each container, and what it takes up.
+	containers map[string]*placement
+	// Which instance runs each exec, and in which container.
+	execs map[string]*execPlacement
+}
+
+// Where a container runs, and what it takes up there.
+type placement struct {
+	host   *ProxyServer
+	cpus   float64
+	memory int64
+}
+
+// Where an exec runs.
+type execPlacement struct {
+	host      *ProxyServer
+	container string
+}
+
+func newFleet(name string, provider dockercloud.Provider, maxHosts int, containerCpus float64, containerMemory int64, newHost func(name string) *ProxyServer) *fleet {
+	return &fleet{
+		name:            name,
+		provider:        provider,
+		maxHosts:        maxHosts,
+		containerCpus:   containerCpus,
+		containerMemory: containerMemory,
+		newHost:         newHost,
+		containers:      make(map[string]*placement),
+		execs:           make(map[string]*execPlacement),
+	}
+}
+
+var (
+	apiPath       = regexp.MustCompile(`^(/v[0-9.]+)?(/.*)$`)
+	containerPath = regexp.MustCompile(`^/containers/([^/]+)(/.*)?$`)
+	execPath      = regexp.MustCompile(`^/exec/([^/]+)(/.*)?$`)
+)
+
+func (f *fleet) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if f.policy != nil {
+		if err := f.policy.check(r); err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+	}
+	ctx := r.Context()
+	if err := f.discover(ctx); err != nil {
+		writeError(w, 500, err)
+		return
+	}
+	path := apiPath.FindStringSubmatch(r.URL.Path)[2]
+	switch {
+	case path == "/containers/json" && r.Method == "GET":
+		if err := f.listContainers(w, r); err != nil {
+			writeError(w, 500, err)
+		}
+	case path == "/containers/create" && r.Method == "POST":
+		if err := f.createContainer(w, r); err != nil {
+			writeError(w, 500, err)
+		}
+	case path == "/containers/prune" && r.Method == "POST":
+		if err := f.pruneContainers(w, r); err != nil {
+			writeError(w, 500, err)
+		}
+	case containerPath.MatchString(path):
+		m := containerPath.FindStringSubmatch(path)
+		host, id, err := f.owner(ctx, "container", m[1])
+		if err != nil {
+			writeError(w, 500, err)
+			return
+		}
+		if host == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("No such container: %s", m[1]))
+			return
+		}
+		if m[2] == "/exec" && r.Method == "POST" {
+			f.serveCreate(host, w, r, func(execID string) {
+				f.mu.Lock()
+				defer f.mu.Unlock()
+				f.execs[execID] = &execPlacement{host: host, container: id}
+			})
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		host.ServeHTTP(rec, r)
+		switch {
+		case m[2] == "" && r.Method == "DELETE" && rec.status == http.StatusNoContent:
+			f.forget("container", id)
+		case rec.status == http.StatusNotFound:
+			f.forgetIfGone(ctx, "container", id, host)
+		}
+	case execPath.MatchString(path):
+		m := execPath.FindStringSubmatch(path)
+		host, id, err := f.owner(ctx, "exec", m[1])
+		if err != nil {
+			writeError(w, 500, err)
+			return
+		}
+		if host == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("No such exec instance: %s", m[1]))
+			return
+		}
+		rec := &statusRecorder{ResponseWriter: w}
+		host.ServeHTTP(rec, r)
+		if rec.status == http.StatusNotFound {
+			f.forgetIfGone(ctx, "exec", id, host)
+		}
+	default:
+		f.currentHost().ServeHTTP(w, r)
+	}
+}
+
+// Finds the instances a previous run of the proxy left behind, which it
+// only knew of in memory, so that their containers are listed and their room
+// is used. Looks once, then the fleet knows what it runs.
+func (f *fleet) discover(ctx context.Context) error {
+	f.discoverMu.Lock()
+	defer f.discoverMu.Unlock()
+	if f.discovered {
+		return nil
+	}
+	last := 0
+	for i := 1; i < f.maxHosts; i++ {
+		_, err := findInstance(ctx, f.provider, f.hostName(i))
+		if err == dockercloud.ErrNoSuchInstance {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		last = i
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// The hosts in between are down, and the first to be brought back.
+	for len(f.hosts) <= last {
+		f.hosts = append(f.hosts, f.newHost(f.hostName(len(f.hosts))))
+	}
+	f.discovered = true
+	return nil
+}
+
+// Returns the hosts of the fleet.
+func (f *fleet) snapshot() []*ProxyServer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*ProxyServer(nil), f.hosts...)
+}
+
+// Returns the host requests that aren't about a container go to, making
+// the first one if there is none yet.
+func (f *fleet) currentHost() *ProxyServer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.current == nil {
+		if len(f.hosts) == 0 {
+			f.hosts = append(f.hosts, f.newHost(f.hostName(0)))
+		}
+		f.current = f.hosts[0]
+	}
+	return f.current
+}
+
+func (f *fleet) hostName(i int) string {
+	if i == 0 {
+		return f.name
+	}
+	return fmt.Sprintf("%s-%d", f.name, i)
+}
+
+// Closes the tunnels to every host.
+func (f *fleet) closeTunnel() {
+	for _, host := range f.snapshot() {
+		host.closeTunnel()
+	}
+}
+
+// Whether every host is idle.
+func (f *fleet) idle() bool {
+	for _, host := range f.snapshot() {
+		if !host.idle() {
+			return false
+		}
+	}
+	return true
+}
+
+// Lists the containers of every host that is up, as one list.
+func (f *fleet) listContainers(w http.ResponseWriter, r *http.Request) error {
+	list := []interface{}{}
+	for _, host := range f.snapshot() {
+		instance, api, err := host.daemon(r.Context())
+		if err != nil {
+			return err
+		}
+		if api == nil {
+			continue
+		}
+		// The client's request, in the API version it asked for.
+		var containers []interface{}
+		if err := getJSON(r.Context(), api.transport, r.URL.RequestURI(), &containers); err != nil {
+			return err
+		}
+		rewriteListPorts(containers, func(port int) string {
+			return host.publishedAddress(instance, port)
+		})
+		list = append(list, containers...)
+	}
+	body, err := json.Marshal(list)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(body)
+	return nil
+}
+
+// Prunes the containers of every host that is up, and adds up what they
+// report.
+func (f *fleet) pruneContainers(w http.ResponseWriter, r *http.Request) error {
+	var total struct {
+		ContainersDeleted []string
+		SpaceReclaimed    int64
+	}
+	for _, host := range f.snapshot() {
+		_, api, err := host.daemon(r.Context())
+		if err != nil {
+			return err
+		}
+		if api == nil {
+			continue
+		}
+		var pruned struct {
+			ContainersDeleted []string
+			SpaceReclaimed    int64
+		}
+		// The client's request, filters and all.
+		if err := requestJSON(r.Context(), api.transport, "POST", r.URL.RequestURI(), &pruned); err != nil {
+			return err
+		}
+		for _, id := range pruned.ContainersDeleted {
+			f.forget("container", id)
+		}
+		total.ContainersDeleted = append(total.ContainersDeleted, pruned.ContainersDeleted...)
+		total.SpaceReclaimed += pruned.SpaceReclaimed
+	}
+	body, err := json.Marshal(total)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write(body)
+	return nil
+}
+
+// The resources a container asks for, in the create request.
+type containerResources struct {
+	Memory     int64
+	HostConfig struct {
+		Memory   int64
+		NanoCpus int64
+	}
+}
+
+// Creates the container on the first host with room for it.
+func (f *fleet) createContainer(w http.ResponseWriter, r *http.Request) error {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	var resources containerResources
+	json.Unmarshal(body, &resources)
+	want := placement{cpus: f.containerCpus, memory: f.containerMemory}
+	if resources.HostConfig.NanoCpus > 0 {
+		want.cpus = float64(resources.HostConfig.NanoCpus) / 1e9
+	}
+	if resources.HostConfig.Memory > 0 {
+		want.memory = resources.HostConfig.Memory
+	} else if resources.Memory > 0 {
+		want.memory = resources.Memory
+	}
+
+	host, err := f.schedule(r.Context(), want)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.current = host
+	f.mu.Unlock()
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	f.serveCreate(host, w, r, func(id string) {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		want.host = host
+		f.containers[id] = &want
+	})
+	return nil
+}
+
+// Picks the host for a container that takes up want: the first host running
+// with room for it, else the first host that isn't running, else a new host.
+// Going for the first rather than the emptiest host fills hosts up one at a
+// time, so that idle ones can be torn down, and lands the retry of a
+// container that needed its image pulled on the same host as the pull.
+func (f *fleet) schedule(ctx context.Context, want placement) (*ProxyServer, error) {
+	hosts := f.snapshot()
+	var down *ProxyServer
+	for _, host := range hosts {
+		_, api, err := host.daemon(ctx)
+		if err != nil {
+			log.Printf("Error reaching instance %q, skipping it: %v", host.instanceName, err)
+			continue
+		}
+		if api == nil {
+			if down == nil {
+				down = host
+			}
+			continue
+		}
+		free, err := f.free(ctx, host, api)
+		if err != nil {
+			log.Printf("Error sizing instance %q up, skipping it: %v", host.instanceName, err)
+			continue
+		}
+		if free.cpus >= want.cpus && free.memory >= want.memory {
+			return host, nil
+		}
+	}
+	if down != nil {
+		return down, nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.hosts) != len(hosts) {
+		// Another request just grew the fleet, use the newcomer.
+		return f.hosts[len(f.hosts)-1], nil
+	}
+	if len(f.hosts) >= f.maxHosts {
+		return nil, fmt.Errorf("all %d instances are full", len(f.hosts))
+	}
+	host := f.newHost(f.hostName(len(f.hosts)))
+	if len(f.hosts) > 0 {
+		log.Printf("All instances are full, adding instance %q", host.instanceName)
+	}
+	f.hosts = append(f.hosts, host)
+	return host, nil
+}
+
+// Returns the room left on host: what the daemon has, less what its running
+// containers take up.
+func (f *fleet) free(ctx context.Context, host *ProxyServer, api *daemonAPI) (placement, error) {
+	var info struct {
+		NCPU     int
+		MemTotal int64
+	}
+	if err := api.getJSON(ctx, "/info", &info); err != nil {
+		return placement{}, err
+	}
+	var running []ContainerStatus
+	if err := api.getJSON(ctx, "/containers/json", &running); err != nil {
+		return placement{}, err
+	}
+	free := placement{cpus: float64(info.NCPU), memory: info.MemTotal}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range running {
+		used := placement{cpus: f.containerCpus, memory: f.containerMemory}
+		if p, ok := f.containers[c.Id]; ok && p.host == host {
+			used = *p
+		}
+		free.cpus -= used.cpus
+		free.memory -= used.memory
+	}
+	return free, nil
+}
+
+// Returns the host running the container or exec known to the client as
+// ref, an id, id prefix or name, and its id, asking the hosts that are up if
+// it isn't known yet. Returns nil if no host has it.
+func (f *fleet) owner(ctx context.Context, kind, ref string) (*ProxyServer, string, error) {
+	f.mu.Lock()
+	var found *ProxyServer
+	var foundID string
+	matches := 0
+	switch kind {
+	case "container":
+		for id, p := range f.containers {
+			if strings.HasPrefix(id, ref) {
+				found, foundID = p.host, id
+				matches++
+			}
+		}
+	case "exec":
+		for id, p := range f.execs {
+			if strings.HasPrefix(id, ref) {
+				found, foundID = p.host, id
+				matches++
+			}
+		}
+	}
+	f.mu.Unlock()
+	// Let the hosts sort out a prefix of several ids.
+	if matches == 1 {
+		return found, foundID, nil
+	}
+
+	path := fmt.Sprintf("/containers/%s/json", ref)
+	if kind == "exec" {
+		path = fmt.Sprintf("/exec/%s/json", ref)
+	}
+	for _, host := range f.snapshot() {
+		_, api, err := host.daemon(ctx)
+		if err != nil {
+			return nil, "", err
+		}
+		if api == nil {
+			continue
+		}
+		var object struct {
+			Id          string
+			ContainerID string
+		}
+		err = api.getJSON(ctx, path, &object)
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		f.mu.Lock()
+		if kind == "exec" {
+			f.execs[object.Id] = &execPlacement{host: host, container: object.ContainerID}
+		} else if _, ok := f.containers[object.Id]; !ok {
+			f.containers[object.Id] = &placement{host: host, cpus: f.containerCpus, memory: f.containerMemory}
+		}
+		f.mu.Unlock()
+		return host, object.Id, nil
+	}
+	return nil, "", nil
+}
+
+// Whether err is the daemon saying there is no such thing.
+func isNotFound(err error) bool {
+	var daemonErr *daemonError
+	return errors.As(err, &daemonErr) && daemonErr.StatusCode == http.StatusNotFound
+}
+
+// Forgets the container or exec with id, along with the execs of the
+// container.
+func (f *fleet) forget(kind, id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if kind == "exec" {
+		delete(f.execs, id)
+		return
+	}
+	delete(f.containers, id)
+	for execID, p := range f.execs {
+		if p.container == id {
+			delete(f.execs, execID)
+		}
+	}
+}
+
+// Forgets the container or exec with id if host no longer has it. A 404
+// may be about something else, such as a missing file in the container.
+func (f *fleet) forgetIfGone(ctx context.Context, kind, id string, host *ProxyServer) {
+	_, api, err := host.daemon(ctx)
+	if err != nil || api == nil {
+		return
+	}
+	path := fmt.Sprintf("/containers/%s/json", id)
+	if kind == "exec" {
+		path = fmt.Sprintf("/exec/%s/json", id)
+	}
+	if err := api.getJSON(ctx, path, &struct{}{}); isNotFound(err) {
+		f.forget(kind, id)
+	}
+}
+
+// Forwards the request creating a container or exec to host, passing the id
+// of what got created to created.
+func (f *fleet) serveCreate(host *ProxyServer, w http.ResponseWriter, r *http.Request, created func(id string)) {
+	rec := &createRecorder{ResponseWriter: w}
+	host.ServeHTTP(rec, r)
+	if rec.status != http.StatusCreated {
+		return
+	}
+	var object struct{ Id string }
+	if err := json.Unmarshal(rec.body.Bytes(), &object); err == nil && object.Id != "" {
+		created(object.Id)
+	}
+}
+
+// Passes a response through, keeping a copy of its status and body.
+type createRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *createRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *createRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(p)
+	return rec.ResponseWriter.Write(p)
+}
+
+// Passes a response through, keeping a copy of its status. Unlike
+// createRecorder it lets streams and hijacked connections through.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(p)
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection hijacking is not supported")
+	}
+	return hj.Hijack()
+}
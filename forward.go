@@ -0,0 +1,275 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/docker-cloud/dockercloud"
+)
+
+// How long to wait before looking for a running instance again, or
+// reconnecting to the event stream after it broke.
+const forwardRetryInterval = 5 * time.Second
+
+// The container events that may change the ports published on an instance.
+var portEvents = map[string]bool{
+	"start":   true,
+	"die":     true,
+	"stop":    true,
+	"kill":    true,
+	"destroy": true,
+}
+
+// Forwards the ports containers publish on the instance to the same ports
+// on localhost, as if the containers ran on the local daemon.
+type portForwards struct {
+	// Reaches port on the instance.
+	dial func(ctx context.Context, port int) (net.Conn, error)
+
+	mu        sync.Mutex
+	listeners map[int]net.Listener
+	// The ports that couldn't be forwarded, because they are taken locally.
+	conflicts map[int]bool
+}
+
+func newPortForwards(dial func(ctx context.Context, port int) (net.Conn, error)) *portForwards {
+	return &portForwards{
+		dial:      dial,
+		listeners: make(map[int]net.Listener),
+		conflicts: make(map[int]bool),
+	}
+}
+
+// Whether port is forwarded to localhost.
+func (fw *portForwards) forwarded(port int) bool {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return fw.listeners[port] != nil
+}
+
+// Forwards exactly ports, opening the forwards that are missing and closing
+// the ones that are no longer needed.
+func (fw *portForwards) update(ports map[int]bool) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	for port, l := range fw.listeners {
+		if !ports[port] {
+			log.Printf("Closing the forward of port %d", port)
+			l.Close()
+			delete(fw.listeners, port)
+		}
+	}
+	for port := range fw.conflicts {
+		if !ports[port] {
+			delete(fw.conflicts, port)
+		}
+	}
+	for port := range ports {
+		if fw.listeners[port] != nil || fw.conflicts[port] {
+			continue
+		}
+		l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			// Only report it once, not every time the ports are updated.
+			log.Printf("Can't forward port %d, it is already in use locally: %v", port, err)
+			fw.conflicts[port] = true
+			continue
+		}
+		log.Printf("Forwarding localhost:%d to the instance", port)
+		fw.listeners[port] = l
+		go fw.serve(l, port)
+	}
+}
+
+// Forwards the connections l accepts to port on the instance, until l is
+// closed.
+func (fw *portForwards) serve(l net.Listener, port int) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			backend, err := fw.dial(context.Background(), port)
+			if err != nil {
+				log.Printf("Error forwarding port %d: %v", port, err)
+				return
+			}
+			defer backend.Close()
+			splice(conn, conn, backend)
+		}()
+	}
+}
+
+// Keeps the ports containers publish on the instance forwarded to localhost,
+// exposed on the instance, or both, following containers as they start and
+// stop, until ctx is done.
+func (server *ProxyServer) watchPorts(ctx context.Context) {
+	if server.forwards != nil {
+		defer server.forwards.update(nil)
+	}
+	for {
+		err := server.followPorts(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Error following published ports: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(forwardRetryInterval):
+		}
+	}
+}
+
+// Forwards and exposes the ports published on the running instance,
+// updating them on every container event, until the instance or the event
+// stream goes away.
+func (server *ProxyServer) followPorts(ctx context.Context) error {
+	instance, api, err := server.daemon(ctx)
+	if err != nil || api == nil {
+		if server.forwards != nil {
+			server.forwards.update(nil)
+		}
+		return err
+	}
+	var publisher dockercloud.PortPublisher
+	if server.exposePorts {
+		var ok bool
+		if publisher, ok = instance.(dockercloud.PortPublisher); !ok {
+			log.Printf("Instance %q can't expose ports, they are only reachable through the tunnel", instance.Name())
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s%s", dockerHost, api.path("/events")), nil)
+	if err != nil {
+		return err
+	}
+	res, err := api.transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("watching events: %s", res.Status)
+	}
+	// Events from now on are streaming in, catch up with what happened
+	// before.
+	var exposed []dockercloud.Port
+	if exposed, err = server.syncPorts(ctx, api, publisher, nil); err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(res.Body)
+	for {
+		var event struct {
+			Status string
+			Action string
+		}
+		if err := decoder.Decode(&event); err != nil {
+			return err
+		}
+		if portEvents[event.Status] || portEvents[event.Action] {
+			if exposed, err = server.syncPorts(ctx, api, publisher, exposed); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Forwards the TCP ports the running containers publish, and only those,
+// and exposes them all through publisher unless it is nil or they already
+// are exposed. Returns the exposed ports.
+func (server *ProxyServer) syncPorts(ctx context.Context, api *daemonAPI, publisher dockercloud.PortPublisher, exposed []dockercloud.Port) ([]dockercloud.Port, error) {
+	var containers []struct {
+		Ports []struct {
+			IP         string
+			PublicPort int
+			Type       string
+		}
+	}
+	if err := api.getJSON(ctx, "/containers/json", &containers); err != nil {
+		return exposed, err
+	}
+	forward := make(map[int]bool)
+	published := make(map[dockercloud.Port]bool)
+	for _, c := range containers {
+		for _, p := range c.Ports {
+			// Ports bound to a specific address aren't meant to be
+			// reached from outside.
+			if p.PublicPort == 0 || !isWildcardIP(p.IP) {
+				continue
+			}
+			published[dockercloud.Port{Number: p.PublicPort, Protocol: p.Type}] = true
+			// SSH only carries TCP.
+			if p.Type == "tcp" {
+				forward[p.PublicPort] = true
+			}
+		}
+	}
+	if server.forwards != nil {
+		server.forwards.update(forward)
+	}
+	if publisher == nil {
+		return exposed, nil
+	}
+	expose := []dockercloud.Port{}
+	for port := range published {
+		expose = append(expose, port)
+	}
+	sort.Slice(expose, func(i, j int) bool {
+		if expose[i].Number != expose[j].Number {
+			return expose[i].Number < expose[j].Number
+		}
+		return expose[i].Protocol < expose[j].Protocol
+	})
+	if exposed != nil && reflect.DeepEqual(expose, exposed) {
+		return exposed, nil
+	}
+	if err := publisher.PublishPorts(ctx, expose); err != nil {
+		return exposed, err
+	}
+	return expose, nil
+}
+
+// Dials port on the instance, through the tunnel.
+func (server *ProxyServer) dialPort(ctx context.Context, port int) (net.Conn, error) {
+	instance, _, err := server.daemon(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if instance == nil {
+		return nil, errors.New("no instance is running")
+	}
+	server.mu.Lock()
+	tunnel := server.tunnel
+	server.mu.Unlock()
+	if tunnel == nil {
+		return nil, errors.New("no tunnel to the instance")
+	}
+	return tunnel.Dial(ctx, port)
+}
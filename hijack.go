@@ -0,0 +1,116 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Returns true if r asks the daemon to take over the connection for a raw
+// bidirectional stream, as attach, exec start and interactive run do.
+func isHijackRequest(r *http.Request) bool {
+	if strings.EqualFold(r.Header.Get("Upgrade"), "tcp") {
+		return true
+	}
+	if r.Method != "POST" {
+		return false
+	}
+	path := r.URL.Path
+	if strings.Contains(path, "/containers/") && strings.HasSuffix(path, "/attach") {
+		return true
+	}
+	return strings.Contains(path, "/exec/") && strings.HasSuffix(path, "/start")
+}
+
+// Anything that can shut down its writing side, like *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Forwards r to the daemon over a connection dialed by transport, then
+// hijacks the client connection and splices it to the daemon connection in
+// both directions.
+// Each direction is half-closed as soon as its source is drained, so the
+// other side sees EOF on stdin while output keeps flowing.
+func hijackRequest(transport *http.Transport, url string, r *http.Request, w http.ResponseWriter) error {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return errors.New("connection hijacking is not supported")
+	}
+	body := r.Body
+	if r.ContentLength == 0 {
+		body = nil
+	}
+	req, err := http.NewRequest(r.Method, url, body)
+	if err != nil {
+		return err
+	}
+	for k, vv := range r.Header {
+		req.Header[k] = vv
+	}
+	req.ContentLength = r.ContentLength
+
+	backend, err := transport.DialContext(r.Context(), "tcp", req.URL.Host)
+	if err != nil {
+		return err
+	}
+	if err = req.Write(backend); err != nil {
+		backend.Close()
+		return err
+	}
+
+	client, brw, err := hj.Hijack()
+	if err != nil {
+		backend.Close()
+		return err
+	}
+	defer client.Close()
+	defer backend.Close()
+
+	// Flush anything the server already buffered from the client first.
+	for _, err := range splice(client, brw.Reader, backend) {
+		// The response is on the wire already, so just log it.
+		log.Printf("hijacked stream for %s: %v", r.URL.Path, err)
+	}
+	return nil
+}
+
+// Copies fromClient to backend and backend to client until both are
+// drained, half-closing each direction as soon as its source is, and returns
+// what went wrong on the way.
+func splice(client net.Conn, fromClient io.Reader, backend net.Conn) []error {
+	done := make(chan error, 2)
+	pipe := func(dst net.Conn, src io.Reader) {
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok {
+			cw.CloseWrite()
+		}
+		done <- err
+	}
+	go pipe(backend, fromClient)
+	go pipe(client, backend)
+	var errs []error
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
@@ -0,0 +1,347 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/docker-cloud/dockercloud"
+)
+
+// Where an instance is in its lifecycle, as far as the proxy knows.
+type instanceState int
+
+const (
+	// Nobody asked the provider yet, or its answer can't be trusted anymore.
+	stateUnknown instanceState = iota
+	stateAbsent
+	stateCreating
+	stateReady
+	// Being deleted, or stopped or suspended.
+	stateDeleting
+	// Stopped or suspended, it is restarted on demand.
+	stateStopped
+)
+
+// An instanceSlot serializes the lifecycle of one named instance, so that
+// concurrent requests share a single creation or restart instead of racing to
+// insert the same instance, and wait for a deletion or shutdown in flight
+// before bringing it back.
+type instanceSlot struct {
+	name          string
+	provider      dockercloud.Provider
+	createTimeout time.Duration
+	// Where to take new instances from before creating one, if anywhere.
+	pool *instancePool
+
+	mu       sync.Mutex
+	state    instanceState
+	instance dockercloud.Instance
+	// The name of the instance, which differs from name when it came from
+	// the pool.
+	current string
+	// Closed when the transition in flight ends.
+	busy chan struct{}
+	// The outcome of the last lookup, creation or restart.
+	err error
+	// Requests waiting on the lookup, creation or restart in flight, which
+	// is cancelled when they all give up.
+	waiters int
+	cancel  context.CancelFunc
+}
+
+func newInstanceSlot(name string, provider dockercloud.Provider, createTimeout time.Duration, pool *instancePool) *instanceSlot {
+	return &instanceSlot{
+		name:          name,
+		provider:      provider,
+		createTimeout: createTimeout,
+		pool:          pool,
+		current:       name,
+	}
+}
+
+// Returns the instance, once it is ready. If there is no running instance, it
+// is created or restarted when create is true, and nil is returned otherwise.
+func (slot *instanceSlot) get(ctx context.Context, create bool) (dockercloud.Instance, error) {
+	slot.mu.Lock()
+	for {
+		switch slot.state {
+		case stateReady:
+			instance := slot.instance
+			slot.mu.Unlock()
+			return instance, nil
+		case stateAbsent, stateStopped:
+			if !create {
+				slot.mu.Unlock()
+				return nil, nil
+			}
+			name := slot.current
+			if slot.state == stateAbsent {
+				slot.begin(ctx, stateCreating, slot.create)
+			} else {
+				slot.begin(ctx, stateCreating, func(ctx context.Context) (dockercloud.Instance, error) {
+					return slot.restart(ctx, name)
+				})
+			}
+		case stateUnknown:
+			name := slot.current
+			slot.begin(ctx, stateCreating, func(ctx context.Context) (dockercloud.Instance, error) {
+				return slot.lookup(ctx, name)
+			})
+		}
+		// Something is in flight, wait for it.
+		busy := slot.busy
+		transition := slot.state == stateCreating
+		if transition {
+			slot.waiters++
+		}
+		slot.mu.Unlock()
+		select {
+		case <-busy:
+		case <-ctx.Done():
+		}
+		slot.mu.Lock()
+		if transition {
+			slot.waiters--
+			if slot.waiters == 0 && slot.cancel != nil {
+				// Nobody is waiting for the instance anymore.
+				slot.cancel()
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			slot.mu.Unlock()
+			return nil, err
+		}
+		if transition && slot.state != stateReady && slot.err != nil {
+			err := slot.err
+			slot.mu.Unlock()
+			return nil, err
+		}
+	}
+}
+
+// The label of a pool instance naming the slot it was handed out to, which
+// is how the proxy finds it again after a restart.
+const slotLabel = "docker-cloud-slot"
+
+// Hands out an instance from the pool, or creates a new one.
+func (slot *instanceSlot) create(ctx context.Context) (dockercloud.Instance, error) {
+	if slot.pool != nil {
+		if instance := slot.pool.take(); instance != nil {
+			log.Printf("Took instance %q from the pool", instance.Name())
+			if labeler, ok := instance.(dockercloud.Labeler); ok {
+				if err := labeler.SetLabel(ctx, slotLabel, slot.name); err != nil {
+					log.Printf("Error labelling instance %q, it will be lost on restart: %v", instance.Name(), err)
+				}
+			}
+			return instance, nil
+		}
+	}
+	return slot.provider.CreateInstance(ctx, slot.name)
+}
+
+// Looks the instance called name up, mapping its absence to a nil instance.
+func (slot *instanceSlot) lookup(ctx context.Context, name string) (dockercloud.Instance, error) {
+	instance, err := findInstance(ctx, slot.provider, name)
+	if err == dockercloud.ErrNoSuchInstance {
+		return nil, nil
+	}
+	return instance, err
+}
+
+// Starts the stopped or suspended instance called name back up.
+func (slot *instanceSlot) restart(ctx context.Context, name string) (dockercloud.Instance, error) {
+	instance, err := findInstance(ctx, slot.provider, name)
+	if err != nil {
+		return nil, err
+	}
+	// It may still be on its way down, or someone else started it already.
+	if instance, err = settle(ctx, slot.provider, instance); instance == nil || err != nil {
+		return nil, err
+	}
+	name = instance.Name()
+	switch instance.Status() {
+	case dockercloud.StatusSuspended:
+		suspender, ok := instance.(dockercloud.Suspender)
+		if !ok {
+			return nil, fmt.Errorf("instance %q is suspended, but can't be resumed", name)
+		}
+		err = suspender.Resume(ctx)
+	case dockercloud.StatusStopped:
+		err = instance.Start(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return slot.provider.GetInstance(ctx, name)
+}
+
+// Returns the instance called name, or else the pool instance handed out in
+// its place, or ErrNoSuchInstance.
+func findInstance(ctx context.Context, provider dockercloud.Provider, name string) (dockercloud.Instance, error) {
+	instance, err := provider.GetInstance(ctx, name)
+	if err != dockercloud.ErrNoSuchInstance {
+		return instance, err
+	}
+	finder, ok := provider.(dockercloud.InstanceFinder)
+	if !ok {
+		return nil, err
+	}
+	found, err := finder.FindInstances(ctx, slotLabel, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, dockercloud.ErrNoSuchInstance
+	}
+	return found[0], nil
+}
+
+// How often to ask the provider about an instance on its way to running,
+// stopped or suspended.
+const statusPollInterval = time.Second
+
+// Waits for instance to be running, stopped or suspended, and returns it as it
+// is then, or nil if it went away meanwhile. An instance found on its way to
+// running is only returned once Docker is up on it, when the provider can tell.
+func settle(ctx context.Context, provider dockercloud.Provider, instance dockercloud.Instance) (dockercloud.Instance, error) {
+	for {
+		switch status := instance.Status(); status {
+		case dockercloud.StatusRunning, dockercloud.StatusStopped, dockercloud.StatusSuspended:
+			return instance, nil
+		default:
+			log.Printf("instance %q is %s, waiting", instance.Name(), status)
+		}
+		if waiter, ok := instance.(dockercloud.Waiter); ok {
+			if err := waiter.WaitForDocker(ctx); err != nil {
+				return nil, err
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(statusPollInterval):
+		}
+		var err error
+		instance, err = provider.GetInstance(ctx, instance.Name())
+		if err == dockercloud.ErrNoSuchInstance {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Starts fetching the instance with fetch in the background, moving to state
+// until it is done. Must be called with slot.mu held.
+func (slot *instanceSlot) begin(ctx context.Context, state instanceState, fetch func(context.Context) (dockercloud.Instance, error)) {
+	// The instance outlives the request that happens to ask for it first, so
+	// only give up when every request waiting for it did.
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	if slot.createTimeout > 0 {
+		ctx, cancel = withTimeout(ctx, cancel, slot.createTimeout)
+	}
+	busy := make(chan struct{})
+	slot.state, slot.busy, slot.cancel, slot.err = state, busy, cancel, nil
+	go func() {
+		instance, err := fetch(ctx)
+		if instance != nil && err == nil {
+			instance, err = settle(ctx, slot.provider, instance)
+		}
+		cancel()
+		slot.mu.Lock()
+		defer slot.mu.Unlock()
+		switch {
+		case err != nil:
+			log.Printf("instance %q: %v", slot.name, err)
+			slot.state, slot.err = stateUnknown, err
+		case instance == nil:
+			slot.state, slot.current = stateAbsent, slot.name
+		case instance.Status() == dockercloud.StatusRunning:
+			slot.state, slot.instance, slot.current = stateReady, instance, instance.Name()
+		default:
+			// Stopped or suspended, settle waited out the rest.
+			slot.state, slot.instance, slot.current = stateStopped, instance, instance.Name()
+		}
+		slot.cancel = nil
+		close(busy)
+	}()
+}
+
+// Derives a context from ctx that times out, and a cancel func that releases
+// both.
+func withTimeout(ctx context.Context, cancel context.CancelFunc, timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancelTimeout := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancelTimeout()
+		cancel()
+	}
+}
+
+// Shuts the instance down with shutdown, unless it isn't ready, is no longer
+// instance or idle says it is in use. idle is called with slot.mu held, in the
+// same critical section that moves the slot to stateDeleting, so that a
+// request it doesn't see waits for the shutdown. If keep is true, shutdown
+// only stops the instance, and it is restarted on demand, otherwise it is gone
+// for good. Requests arriving in the meantime wait for the shutdown, then
+// bring an instance back up.
+func (slot *instanceSlot) shutdown(ctx context.Context, instance dockercloud.Instance, keep bool, idle func() bool, shutdown func(context.Context, dockercloud.Instance) error) error {
+	slot.mu.Lock()
+	if slot.state != stateReady || slot.instance != instance || !idle() {
+		slot.mu.Unlock()
+		return nil
+	}
+	busy := make(chan struct{})
+	slot.state, slot.busy = stateDeleting, busy
+	slot.mu.Unlock()
+
+	err := shutdown(ctx, instance)
+
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	switch {
+	case err != nil:
+		// Who knows what's left, ask the provider next time.
+		slot.state, slot.instance = stateUnknown, nil
+	case keep:
+		slot.state = stateStopped
+	default:
+		slot.state, slot.instance, slot.current = stateAbsent, nil, slot.name
+	}
+	close(busy)
+	return err
+}
+
+// Whether the instance is known to be gone, or stopped.
+func (slot *instanceSlot) down() bool {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	return slot.state == stateAbsent || slot.state == stateStopped
+}
+
+// Forgets what the slot knows about the instance, for instance because it
+// turned out to be gone, so that the next request asks the provider again.
+func (slot *instanceSlot) invalidate(instance dockercloud.Instance) {
+	slot.mu.Lock()
+	defer slot.mu.Unlock()
+	if slot.state == stateReady && slot.instance == instance {
+		slot.state, slot.instance = stateUnknown, nil
+	}
+}
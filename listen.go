@@ -0,0 +1,106 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The addresses given to -listen, which may be given several times.
+type listenAddrs []string
+
+func (addrs *listenAddrs) String() string {
+	return strings.Join(*addrs, ",")
+}
+
+func (addrs *listenAddrs) Set(addr string) error {
+	*addrs = append(*addrs, addr)
+	return nil
+}
+
+// Parses the permissions given to -socketmode, in octal.
+func parseSocketMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m&^0777 != 0 {
+		return 0, fmt.Errorf("invalid socket mode %q", mode)
+	}
+	return os.FileMode(m), nil
+}
+
+// Listens on addr, either unix:///path/to/socket, tcp://host:port or just
+// host:port, and returns the listener with the flags docker takes to reach
+// it. Unix sockets get mode as their permissions, TCP addresses serve TLS with
+// tlsConfig, unless it is nil.
+func listen(addr string, mode os.FileMode, tlsConfig *tls.Config) (net.Listener, string, error) {
+	if strings.HasPrefix(addr, "unix://") {
+		path := addr[len("unix://"):]
+		if err := removeStaleSocket(path); err != nil {
+			return nil, "", err
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, "", err
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, "", err
+		}
+		return l, addr, nil
+	}
+	l, err := net.Listen("tcp", strings.TrimPrefix(addr, "tcp://"))
+	if err != nil {
+		return nil, "", err
+	}
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	if ip := net.ParseIP(host); ip == nil || ip.IsUnspecified() {
+		host = "localhost"
+	}
+	hostFlag := "tcp://" + net.JoinHostPort(host, port)
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+		if tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert {
+			hostFlag += " --tlsverify"
+		} else {
+			hostFlag += " --tls"
+		}
+	}
+	return l, hostFlag, nil
+}
+
+// Removes the socket left at path by a proxy that didn't get to clean up
+// after itself. Refuses to touch anything that isn't a socket, or a socket
+// something still listens on.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use", path)
+	}
+	return os.Remove(path)
+}
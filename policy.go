@@ -0,0 +1,341 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// A policy restricts what clients may ask the docker daemon for, read from a
+// JSON file such as:
+//
+//	{
+//	  "Endpoints": [
+//	    {"Method": "GET", "Path": "/containers/*"},
+//	    {"Method": "POST", "Path": "/containers/*/start"}
+//	  ],
+//	  "AllowPrivileged": false,
+//	  "AllowedBinds": ["/data"],
+//	  "AllowHostNetwork": false
+//	}
+type policy struct {
+	// The endpoints clients may call, every endpoint when there is no
+	// Endpoints list at all.
+	Endpoints []endpoint
+	// Whether containers and execs may run privileged, or with what comes
+	// close: added capabilities, devices, the namespaces of the instance
+	// and security options other than no-new-privileges.
+	AllowPrivileged bool
+	// The paths on the instance containers may bind mount, along with what
+	// is below them, including through volumes of the local driver. Other
+	// volumes are always allowed.
+	AllowedBinds []string
+	// Whether containers and builds may use the network of the instance
+	// (--net=host), or of another container.
+	AllowHostNetwork bool
+}
+
+// An endpoint of the docker API, without the version prefix. Path may hold
+// wildcards as understood by path.Match, so /containers/* matches
+// /containers/json but not /containers/id/start. An empty or * Method
+// matches every method.
+type endpoint struct {
+	Method string
+	Path   string
+}
+
+// Reads the policy in file, rejecting fields it doesn't know of, which are
+// likely to be misspelled restrictions.
+func loadPolicy(file string) (*policy, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var p policy
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&p); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", file, err)
+	}
+	for _, e := range p.Endpoints {
+		if _, err := path.Match(e.Path, ""); err != nil {
+			return nil, fmt.Errorf("invalid policy %s: bad path %q", file, e.Path)
+		}
+	}
+	return &p, nil
+}
+
+// The part of the requests creating or starting containers, or creating
+// execs, that policies look at. Older clients pass the host config when
+// starting containers rather than when creating them, at the top level.
+type policyRequest struct {
+	hostConfig
+	HostConfig hostConfig
+}
+
+type hostConfig struct {
+	Privileged        bool
+	CapAdd            []string
+	Devices           []struct{}
+	DeviceCgroupRules []string
+	SecurityOpt       []string
+	PidMode           string
+	IpcMode           string
+	UTSMode           string
+	UsernsMode        string
+	CgroupnsMode      string
+	NetworkMode       string
+	Binds             []string
+	Mounts            []struct {
+		Type          string
+		Source        string
+		VolumeOptions *struct {
+			DriverConfig *volumeDriver
+		}
+	}
+}
+
+// The volume driver and its options, as given when creating a volume.
+type volumeDriver struct {
+	Name    string
+	Options map[string]string
+}
+
+// Returns an error saying why the policy forbids r, if it does. The body of
+// r is left for the request to be forwarded.
+func (p *policy) check(r *http.Request) error {
+	api := apiPath.FindStringSubmatch(r.URL.Path)[2]
+	if !p.allows(r.Method, api) {
+		return fmt.Errorf("%s %s is not allowed", r.Method, api)
+	}
+	if !p.AllowPrivileged && managesDaemon(api) {
+		return fmt.Errorf("%s %s is not allowed without AllowPrivileged", r.Method, api)
+	}
+	if r.Method != "POST" {
+		return nil
+	}
+	switch {
+	case api == "/build":
+		return p.checkNetworkMode(r.URL.Query().Get("networkmode"))
+	case api == "/volumes/create":
+		var req struct {
+			Driver     string
+			DriverOpts map[string]string
+		}
+		if err := readPolicyRequest(r, &req); err != nil {
+			return err
+		}
+		return p.checkVolume(volumeDriver{req.Driver, req.DriverOpts})
+	case createsContainers(api):
+		var req policyRequest
+		if err := readPolicyRequest(r, &req); err != nil {
+			return err
+		}
+		for _, config := range []hostConfig{req.hostConfig, req.HostConfig} {
+			if err := p.checkHostConfig(config); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Decodes the JSON body of r into v, unless it is empty, and puts the body
+// back for the request to be forwarded.
+func readPolicyRequest(r *http.Request, v interface{}) error {
+	data, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(data))
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("cannot check the request against the policy: %v", err)
+	}
+	return nil
+}
+
+// Whether the policy lets clients call method on apiPath.
+func (p *policy) allows(method, apiPath string) bool {
+	if p.Endpoints == nil {
+		return true
+	}
+	for _, e := range p.Endpoints {
+		if e.Method != "" && e.Method != "*" && !strings.EqualFold(e.Method, method) {
+			continue
+		}
+		if ok, _ := path.Match(e.Path, apiPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether POSTing to apiPath creates or starts a container, or creates an
+// exec, with what the policy has a say about.
+func createsContainers(apiPath string) bool {
+	if apiPath == "/containers/create" {
+		return true
+	}
+	m := containerPath.FindStringSubmatch(apiPath)
+	return m != nil && (m[2] == "/start" || m[2] == "/exec")
+}
+
+// Whether apiPath is part of the swarm, service or plugin API. Services run
+// containers with mounts and capabilities of their own, plugins run with
+// whatever privileges they ask for and the swarm API hands out join tokens,
+// none of which go through checkHostConfig.
+func managesDaemon(apiPath string) bool {
+	for _, prefix := range []string{"/swarm", "/services", "/plugins"} {
+		if apiPath == prefix || strings.HasPrefix(apiPath, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns an error if the policy forbids running with config.
+func (p *policy) checkHostConfig(config hostConfig) error {
+	if !p.AllowPrivileged {
+		if err := checkUnprivileged(config); err != nil {
+			return err
+		}
+	}
+	if err := p.checkNetworkMode(config.NetworkMode); err != nil {
+		return err
+	}
+	var sources []string
+	for _, bind := range config.Binds {
+		sources = append(sources, strings.SplitN(bind, ":", 2)[0])
+	}
+	for _, mount := range config.Mounts {
+		switch {
+		case mount.Type == "bind":
+			sources = append(sources, mount.Source)
+		case mount.Type == "volume" && mount.VolumeOptions != nil && mount.VolumeOptions.DriverConfig != nil:
+			if err := p.checkVolume(*mount.VolumeOptions.DriverConfig); err != nil {
+				return err
+			}
+		}
+	}
+	for _, source := range sources {
+		// Anything else is the name of a volume.
+		if strings.HasPrefix(source, "/") && !p.allowsBind(source) {
+			return fmt.Errorf("bind mounting %s is not allowed", source)
+		}
+	}
+	return nil
+}
+
+// Returns an error if config asks for more than an unprivileged container
+// gets.
+func checkUnprivileged(config hostConfig) error {
+	if config.Privileged {
+		return fmt.Errorf("privileged containers are not allowed")
+	}
+	if len(config.CapAdd) > 0 {
+		return fmt.Errorf("adding capabilities is not allowed")
+	}
+	if len(config.Devices) > 0 || len(config.DeviceCgroupRules) > 0 {
+		return fmt.Errorf("devices are not allowed")
+	}
+	for _, ns := range []struct{ name, mode string }{
+		{"pid", config.PidMode},
+		{"ipc", config.IpcMode},
+		{"uts", config.UTSMode},
+		{"userns", config.UsernsMode},
+		{"cgroupns", config.CgroupnsMode},
+	} {
+		if ns.mode == "host" {
+			return fmt.Errorf("the %s namespace of the instance is not allowed", ns.name)
+		}
+	}
+	for _, opt := range config.SecurityOpt {
+		// The only option that takes privileges away rather than
+		// granting them.
+		switch opt {
+		case "no-new-privileges", "no-new-privileges=true", "no-new-privileges:true":
+		default:
+			return fmt.Errorf("security option %q is not allowed", opt)
+		}
+	}
+	return nil
+}
+
+// Returns an error if the policy forbids running in network mode.
+func (p *policy) checkNetworkMode(mode string) error {
+	if p.AllowHostNetwork {
+		return nil
+	}
+	if mode == "host" {
+		return fmt.Errorf("containers are not allowed on the host network")
+	}
+	// The other container may well be on the host network.
+	if strings.HasPrefix(mode, "container:") {
+		return fmt.Errorf("containers are not allowed on the network of another container")
+	}
+	return nil
+}
+
+// Returns an error if the policy forbids creating a volume with driver.
+// Volumes of the local driver are mounts of their device option, which
+// makes them bind mounts unless the device is a remote share or tmpfs.
+func (p *policy) checkVolume(driver volumeDriver) error {
+	if driver.Name != "" && driver.Name != "local" {
+		return nil
+	}
+	device := driver.Options["device"]
+	if device == "" {
+		return nil
+	}
+	bind := false
+	for _, o := range strings.Split(driver.Options["o"], ",") {
+		bind = bind || o == "bind" || o == "rbind"
+	}
+	switch driver.Options["type"] {
+	case "tmpfs", "nfs", "nfs4", "cifs":
+		if !bind {
+			return nil
+		}
+	}
+	// The daemon resolves relative paths from the root.
+	if source := path.Join("/", device); !p.allowsBind(source) {
+		return fmt.Errorf("mounting %s in a volume is not allowed", source)
+	}
+	return nil
+}
+
+// Whether the policy lets containers bind mount source.
+func (p *policy) allowsBind(source string) bool {
+	source = path.Clean(source)
+	for _, allowed := range p.AllowedBinds {
+		allowed = path.Clean(allowed)
+		if source == allowed || strings.HasPrefix(source, strings.TrimSuffix(allowed, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,265 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/googlecloudplatform/docker-cloud/dockercloud"
+)
+
+// How often the pool looks for instances that idled for too long, at most.
+const maxPoolCheckInterval = time.Minute
+
+// The label of pool instances, holding the prefix of the pool, which is how
+// the next run of the proxy finds those a previous one left behind.
+const poolLabel = "docker-cloud-pool"
+
+// An instancePool keeps instances created ahead of time, with Docker up and
+// running, so that a request for a new instance doesn't have to wait for one
+// to boot.
+type instancePool struct {
+	provider dockercloud.Provider
+	// Pool instances are named after prefix, so they don't clash with the
+	// instances the proxy creates by name.
+	prefix string
+	size   int
+	// How long an instance may sit in the pool before it is replaced with a
+	// fresh one, 0 keeps it forever.
+	maxAge        time.Duration
+	createTimeout time.Duration
+
+	mu   sync.Mutex
+	idle []pooledInstance
+	// Signals the background filler that an instance was handed out.
+	refill chan struct{}
+}
+
+type pooledInstance struct {
+	instance dockercloud.Instance
+	created  time.Time
+}
+
+func newInstancePool(provider dockercloud.Provider, prefix string, size int, maxAge, createTimeout time.Duration) *instancePool {
+	return &instancePool{
+		provider:      provider,
+		prefix:        prefix,
+		size:          size,
+		maxAge:        maxAge,
+		createTimeout: createTimeout,
+		refill:        make(chan struct{}, 1),
+	}
+}
+
+// Hands out the oldest instance in the pool, or nil if the pool is empty.
+// Instances past maxAge are on their way out, and never handed out.
+func (pool *instancePool) take() dockercloud.Instance {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for i, p := range pool.idle {
+		if pool.expired(p) {
+			continue
+		}
+		pool.idle = append(pool.idle[:i], pool.idle[i+1:]...)
+		select {
+		case pool.refill <- struct{}{}:
+		default:
+		}
+		return p.instance
+	}
+	return nil
+}
+
+// Returns how many instances are waiting in the pool, not counting those
+// past maxAge.
+func (pool *instancePool) len() int {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	n := 0
+	for _, p := range pool.idle {
+		if !pool.expired(p) {
+			n++
+		}
+	}
+	return n
+}
+
+// Whether p idled in the pool for longer than maxAge.
+func (pool *instancePool) expired(p pooledInstance) bool {
+	return pool.maxAge > 0 && time.Since(p.created) > pool.maxAge
+}
+
+// Takes instance out of the pool.
+func (pool *instancePool) remove(instance dockercloud.Instance) {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	for i, p := range pool.idle {
+		if p.instance == instance {
+			pool.idle = append(pool.idle[:i], pool.idle[i+1:]...)
+			return
+		}
+	}
+}
+
+// Keeps the pool full until ctx is done.
+func (pool *instancePool) run(ctx context.Context) {
+	interval := maxPoolCheckInterval
+	if pool.maxAge > 0 && pool.maxAge/4 < interval {
+		interval = pool.maxAge / 4
+	}
+	if interval < minReapInterval {
+		interval = minReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	if err := pool.adopt(ctx); err != nil && ctx.Err() == nil {
+		log.Printf("Error looking for the pool instances of a previous run: %v", err)
+	}
+	for {
+		if err := pool.fill(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("Error filling the instance pool: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-pool.refill:
+		case <-ticker.C:
+		}
+	}
+}
+
+// Takes the pool instances a previous run of the proxy left behind back, up
+// to size of them, and deletes the others. Those it handed out to a slot are
+// the slot's. There is no telling how long the others idled already, so they
+// start over.
+func (pool *instancePool) adopt(ctx context.Context) error {
+	finder, ok := pool.provider.(dockercloud.InstanceFinder)
+	if !ok {
+		return nil
+	}
+	found, err := finder.FindInstances(ctx, poolLabel, pool.prefix)
+	if err != nil {
+		return err
+	}
+	for _, instance := range found {
+		if instance.Labels()[slotLabel] != "" {
+			continue
+		}
+		pool.mu.Lock()
+		adopted := instance.Status() == dockercloud.StatusRunning && len(pool.idle) < pool.size
+		if adopted {
+			pool.idle = append(pool.idle, pooledInstance{instance, time.Now()})
+		}
+		pool.mu.Unlock()
+		if adopted {
+			log.Printf("Adopting pool instance %q", instance.Name())
+			continue
+		}
+		log.Printf("Deleting pool instance %q, left over from a previous run", instance.Name())
+		if err := instance.Delete(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deletes the instances that idled in the pool for longer than maxAge, then
+// creates instances until there are size of them. An instance stays in the
+// pool until it is deleted, so that it isn't lost track of when that fails.
+func (pool *instancePool) fill(ctx context.Context) error {
+	pool.mu.Lock()
+	var expired []dockercloud.Instance
+	for _, p := range pool.idle {
+		if pool.expired(p) {
+			expired = append(expired, p.instance)
+		}
+	}
+	pool.mu.Unlock()
+	for _, instance := range expired {
+		log.Printf("Deleting pool instance %q, it idled for too long", instance.Name())
+		if err := instance.Delete(ctx); err != nil {
+			return err
+		}
+		pool.remove(instance)
+	}
+
+	for pool.len() < pool.size {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := pool.prefix + strconv.FormatInt(time.Now().UnixNano(), 36)
+		log.Printf("Creating pool instance %q", name)
+		createCtx, cancel := ctx, context.CancelFunc(func() {})
+		if pool.createTimeout > 0 {
+			createCtx, cancel = context.WithTimeout(ctx, pool.createTimeout)
+		}
+		instance, err := pool.provider.CreateInstance(createCtx, name)
+		if labeler, ok := instance.(dockercloud.Labeler); ok && err == nil {
+			// Unlabelled, the instance would be lost on a restart.
+			err = labeler.SetLabel(createCtx, poolLabel, pool.prefix)
+		}
+		cancel()
+		if err != nil {
+			pool.deleteLeftover(ctx, name)
+			return fmt.Errorf("creating pool instance %q: %v", name, err)
+		}
+		pool.mu.Lock()
+		pool.idle = append(pool.idle, pooledInstance{instance, time.Now()})
+		pool.mu.Unlock()
+	}
+	return nil
+}
+
+// Deletes what a failed creation left of the pool instance called name,
+// which nobody would know of otherwise. Goes through with it even when ctx is
+// done, as happens when the proxy shuts down in the middle of a creation.
+func (pool *instancePool) deleteLeftover(ctx context.Context, name string) {
+	ctx = context.WithoutCancel(ctx)
+	if pool.createTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, pool.createTimeout)
+		defer cancel()
+	}
+	instance, err := pool.provider.GetInstance(ctx, name)
+	if err == dockercloud.ErrNoSuchInstance {
+		return
+	}
+	if err == nil {
+		log.Printf("Deleting pool instance %q, it failed to come up", name)
+		err = instance.Delete(ctx)
+	}
+	if err != nil {
+		log.Printf("Error deleting pool instance %q: %v", name, err)
+	}
+}
+
+// Deletes every instance left in the pool.
+func (pool *instancePool) drain(ctx context.Context) {
+	pool.mu.Lock()
+	idle := pool.idle
+	pool.idle = nil
+	pool.mu.Unlock()
+	for _, p := range idle {
+		log.Printf("Deleting pool instance %q", p.instance.Name())
+		if err := p.instance.Delete(ctx); err != nil {
+			log.Printf("Error deleting pool instance %q: %v", p.instance.Name(), err)
+		}
+	}
+}
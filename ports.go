@@ -0,0 +1,99 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/googlecloudplatform/docker-cloud/dockercloud"
+)
+
+// Returns how to rewrite the response to r so that the ports containers
+// publish on instance show up at an address the client can reach, or nil if
+// there is nothing to rewrite.
+func (server *ProxyServer) portRewriter(r *http.Request, instance dockercloud.Instance) func(interface{}) {
+	if r.Method != "GET" {
+		return nil
+	}
+	address := func(port int) string {
+		return server.publishedAddress(instance, port)
+	}
+	path := apiPath.FindStringSubmatch(r.URL.Path)[2]
+	if path == "/containers/json" {
+		return func(v interface{}) { rewriteListPorts(v, address) }
+	}
+	if m := containerPath.FindStringSubmatch(path); m != nil && m[2] == "/json" {
+		return func(v interface{}) { rewriteInspectPorts(v, address) }
+	}
+	return nil
+}
+
+// Returns the address the client reaches port, as published by a container
+// on instance, at.
+func (server *ProxyServer) publishedAddress(instance dockercloud.Instance, port int) string {
+	if server.forwards != nil && server.forwards.forwarded(port) {
+		return "127.0.0.1"
+	}
+	return instance.IP()
+}
+
+// Whether ip stands for every address of the instance, which the client
+// can't make sense of.
+func isWildcardIP(ip string) bool {
+	return ip == "" || ip == "0.0.0.0" || ip == "::"
+}
+
+// Rewrites the addresses ports are published at in a container list, as
+// returned by /containers/json.
+func rewriteListPorts(v interface{}, address func(port int) string) {
+	containers, _ := v.([]interface{})
+	for _, c := range containers {
+		container, _ := c.(map[string]interface{})
+		ports, _ := container["Ports"].([]interface{})
+		for _, p := range ports {
+			port, _ := p.(map[string]interface{})
+			ip, _ := port["IP"].(string)
+			public, _ := port["PublicPort"].(json.Number)
+			n, err := public.Int64()
+			if err != nil || n == 0 || !isWildcardIP(ip) {
+				continue
+			}
+			port["IP"] = address(int(n))
+		}
+	}
+}
+
+// Rewrites the addresses ports are published at in a container, as returned
+// by /containers/{id}/json.
+func rewriteInspectPorts(v interface{}, address func(port int) string) {
+	container, _ := v.(map[string]interface{})
+	settings, _ := container["NetworkSettings"].(map[string]interface{})
+	ports, _ := settings["Ports"].(map[string]interface{})
+	for _, b := range ports {
+		bindings, _ := b.([]interface{})
+		for _, b := range bindings {
+			binding, _ := b.(map[string]interface{})
+			ip, _ := binding["HostIp"].(string)
+			hostPort, _ := binding["HostPort"].(string)
+			n, err := strconv.Atoi(hostPort)
+			if err != nil || n == 0 || !isWildcardIP(ip) {
+				continue
+			}
+			binding["HostIp"] = address(n)
+		}
+	}
+}
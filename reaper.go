@@ -0,0 +1,107 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Bounds on how often the reaper checks whether the instance is idle.
+const (
+	minReapInterval = time.Second
+	maxReapInterval = time.Minute
+)
+
+func (server *ProxyServer) beginRequest() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.active++
+}
+
+func (server *ProxyServer) endRequest() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.active--
+	server.lastActive = time.Now()
+}
+
+// Whether the proxy serves no request, and has gone idleTimeout without
+// serving one. Streams like attach or logs -f count as activity for as long as
+// they are open.
+func (server *ProxyServer) idleTimedOut() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.active == 0 && time.Since(server.lastActive) >= server.idleTimeout
+}
+
+// Whether the proxy serves no request and its instance is shut down.
+func (server *ProxyServer) idle() bool {
+	server.mu.Lock()
+	slot, active := server.slot, server.active
+	server.mu.Unlock()
+	return active == 0 && (slot == nil || slot.down())
+}
+
+// Periodically tears the instance down once it has been idle for idleTimeout,
+// until ctx is done. Catches every way containers go away, be it docker stop,
+// rm -f, kill, run --rm or a container simply exiting.
+func (server *ProxyServer) reapIdle(ctx context.Context) {
+	if server.idleTimeout <= 0 {
+		return
+	}
+	// An instance left over from a previous run gets a full idle period too.
+	server.mu.Lock()
+	server.lastActive = time.Now()
+	server.mu.Unlock()
+
+	interval := server.idleTimeout / 4
+	if interval < minReapInterval {
+		interval = minReapInterval
+	}
+	if interval > maxReapInterval {
+		interval = maxReapInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := server.reapIfIdle(ctx); err != nil {
+			log.Printf("Error reaping idle instance: %v", err)
+		}
+	}
+}
+
+// Shuts the instance down if nothing happened for idleTimeout and it runs no
+// containers.
+func (server *ProxyServer) reapIfIdle(ctx context.Context) error {
+	if !server.idleTimedOut() {
+		return nil
+	}
+	instance, err := server.instanceSlot().get(ctx, false)
+	if err != nil || instance == nil {
+		return err
+	}
+	api, err := server.openTunnel(ctx, instance)
+	if err != nil {
+		return err
+	}
+	return server.maybeShutdown(ctx, api, instance)
+}
@@ -0,0 +1,221 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// The longest instance name the clouds accept.
+const maxInstanceNameLen = 63
+
+// What serves the requests of a client: a ProxyServer in front of a single
+// instance, or a fleet of them.
+type backend interface {
+	http.Handler
+	closeTunnel()
+	// Whether it serves nothing and its instances are shut down, so that
+	// nothing is lost by letting go of it.
+	idle() bool
+}
+
+// A router gives each client its own backend, and so its own instances, so
+// that one proxy can serve many developers in isolation.
+type router struct {
+	// Tells which client a request comes from.
+	keyOf func(*http.Request) (string, error)
+	// Makes the backend serving the client with the given key, which runs
+	// until ctx is done.
+	newBackend func(ctx context.Context, key string) backend
+	// How many clients may have a backend at once.
+	maxClients int
+	ctx        context.Context
+
+	mu       sync.Mutex
+	backends map[string]*routedBackend
+}
+
+// The backend of a client, and the requests it serves.
+type routedBackend struct {
+	backend
+	// Stops what the backend runs in the background.
+	cancel context.CancelFunc
+	// Requests in flight.
+	active int
+}
+
+func newRouter(ctx context.Context, keyOf func(*http.Request) (string, error), maxClients int, newBackend func(ctx context.Context, key string) backend) *router {
+	return &router{
+		keyOf:      keyOf,
+		newBackend: newBackend,
+		maxClients: maxClients,
+		ctx:        ctx,
+		backends:   make(map[string]*routedBackend),
+	}
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, err := rt.keyOf(r)
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	b, err := rt.begin(key)
+	if err != nil {
+		writeError(w, http.StatusServiceUnavailable, err)
+		return
+	}
+	defer rt.end(b)
+	b.ServeHTTP(w, r)
+}
+
+// Returns the backend serving the client with key, making it on first use,
+// and counts a request in. Backends that went idle make room for it, and
+// it is refused if there still are maxClients of them.
+func (rt *router) begin(key string) (*routedBackend, error) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	b, ok := rt.backends[key]
+	if !ok {
+		rt.removeIdleLocked()
+		if len(rt.backends) >= rt.maxClients {
+			return nil, fmt.Errorf("too many clients, at most %d may use the proxy at once", rt.maxClients)
+		}
+		ctx, cancel := context.WithCancel(rt.ctx)
+		b = &routedBackend{backend: rt.newBackend(ctx, key), cancel: cancel}
+		rt.backends[key] = b
+	}
+	b.active++
+	return b, nil
+}
+
+func (rt *router) end(b *routedBackend) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	b.active--
+}
+
+// Lets go of the backends that serve no request and whose instances are
+// shut down. Must be called with rt.mu held.
+func (rt *router) removeIdleLocked() {
+	for key, b := range rt.backends {
+		if b.active == 0 && b.idle() {
+			b.cancel()
+			b.closeTunnel()
+			delete(rt.backends, key)
+		}
+	}
+}
+
+// Closes the tunnels of every backend.
+func (rt *router) closeTunnel() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, b := range rt.backends {
+		b.closeTunnel()
+	}
+}
+
+// Ways of telling clients apart, given to -routeby.
+const (
+	routeByCert   = "cert"
+	routeByToken  = "token"
+	routeByHeader = "header:"
+)
+
+// Returns a func that tells which client a request comes from, going by
+// spec, one of:
+//
+//	cert         the common name of the TLS client certificate
+//	token        the bearer token in the Authorization header
+//	header:Name  the value of the Name header
+//
+// It also tells whether the key is a secret, which must not show in instance
+// names.
+func routeKeyFunc(spec string) (keyOf func(*http.Request) (string, error), secret bool, err error) {
+	switch {
+	case spec == routeByCert:
+		return certKey, false, nil
+	case spec == routeByToken:
+		return tokenKey, true, nil
+	case strings.HasPrefix(spec, routeByHeader) && len(spec) > len(routeByHeader):
+		name := http.CanonicalHeaderKey(spec[len(routeByHeader):])
+		return func(r *http.Request) (string, error) {
+			key := r.Header.Get(name)
+			if key == "" {
+				return "", fmt.Errorf("missing %s header", name)
+			}
+			return key, nil
+		}, false, nil
+	}
+	return nil, false, fmt.Errorf("unknown routing %q, pick one of: %s, %s, %sName", spec, routeByCert, routeByToken, routeByHeader)
+}
+
+func certKey(r *http.Request) (string, error) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", errors.New("missing client certificate")
+	}
+	key := r.TLS.PeerCertificates[0].Subject.CommonName
+	if key == "" {
+		return "", errors.New("client certificate has no common name")
+	}
+	return key, nil
+}
+
+func tokenKey(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") || strings.TrimSpace(auth[7:]) == "" {
+		return "", errors.New("missing bearer token")
+	}
+	return strings.TrimSpace(auth[7:]), nil
+}
+
+// Names the instance of the client with key after base. Keys are mapped to
+// the lowercase letters, digits and dashes instance names are made of, with a
+// hash of the key to keep keys that map to the same name apart. A secret key
+// only shows as its hash.
+func routedInstanceName(base, key string, secret bool) string {
+	sum := sha256.Sum256([]byte(key))
+	hash := hex.EncodeToString(sum[:4])
+	if secret {
+		return base + "-" + hash
+	}
+	slug := make([]byte, 0, len(key))
+	for _, c := range []byte(strings.ToLower(key)) {
+		switch {
+		case 'a' <= c && c <= 'z', '0' <= c && c <= '9':
+			slug = append(slug, c)
+		case len(slug) > 0 && slug[len(slug)-1] != '-':
+			slug = append(slug, '-')
+		}
+	}
+	// Leave room for the suffix of the instances of a fleet.
+	room := maxInstanceNameLen - len(base) - len(hash) - len("--") - len("-999")
+	if room < 0 {
+		room = 0
+	}
+	if len(slug) > room {
+		slug = slug[:room]
+	}
+	name := strings.TrimRight(base+"-"+string(slug), "-")
+	return name + "-" + hash
+}
@@ -0,0 +1,89 @@
+//
+// Copyright (C) 2013 The Docker Cloud authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// The newest docker API version the proxy's own requests are written for.
+// Newer daemons are spoken to in this version, as long as they still support
+// it, so that their responses look the way the proxy expects.
+const maxAPIVersion = "1.41"
+
+// Asks the daemon behind transport which API versions it supports, and picks
+// the one the proxy speaks to it. Returns an empty version, which leaves it
+// to the daemon, if the daemon is too old to say.
+func negotiateVersion(ctx context.Context, transport http.RoundTripper) (string, error) {
+	var version struct {
+		ApiVersion    string
+		MinAPIVersion string
+	}
+	// Unversioned, any daemon answers it.
+	if err := getJSON(ctx, transport, "/version", &version); err != nil {
+		return "", fmt.Errorf("getting the docker API version: %v", err)
+	}
+	if _, ok := parseAPIVersion(version.ApiVersion); !ok {
+		log.Printf("Docker daemon doesn't report its API version, using its default")
+		return "", nil
+	}
+	if compareAPIVersions(version.ApiVersion, maxAPIVersion) <= 0 {
+		return version.ApiVersion, nil
+	}
+	if _, ok := parseAPIVersion(version.MinAPIVersion); ok && compareAPIVersions(version.MinAPIVersion, maxAPIVersion) > 0 {
+		// The daemon dropped the versions the proxy knows of, the oldest
+		// it supports is the closest.
+		return version.MinAPIVersion, nil
+	}
+	return maxAPIVersion, nil
+}
+
+// Parses an API version such as 1.41 into its major and minor numbers.
+func parseAPIVersion(version string) ([2]int, bool) {
+	var v [2]int
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return v, false
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return v, false
+		}
+		v[i] = n
+	}
+	return v, true
+}
+
+// Returns -1, 0 or 1 as API version a is older than, the same as, or newer
+// than b. Both must parse.
+func compareAPIVersions(a, b string) int {
+	va, _ := parseAPIVersion(a)
+	vb, _ := parseAPIVersion(b)
+	for i := range va {
+		if va[i] != vb[i] {
+			if va[i] < vb[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}